@@ -0,0 +1,247 @@
+package main
+
+import "errors"
+
+// CONCURRENT API
+//
+// These functions drive the file system from Go code instead of an input script and
+// are safe to call from many goroutines once init_fs has run. Handles are OFT indexes,
+// data moves through byte slices instead of the shared memory area, and each call only
+// takes the locks it needs: operations on different open files proceed in parallel.
+
+var errFS = errors.New("file system error")
+var errWouldBlock = errors.New("lock held by another owner")
+var errDeadlock = errors.New("deadlock detected")
+var errChecksum = errors.New("block checksum mismatch")
+var errDiskFull = errors.New("no free blocks left")
+
+// codeToError turns the -1 and checksumError results of the core operations into errors
+func codeToError(code int) error {
+	if code == checksumError {
+		return errChecksum
+	}
+	if code < 0 {
+		return errFS
+	}
+	return nil
+}
+
+func toInts(p []byte) []int {
+	data := make([]int, len(p))
+	for i := 0; i < len(p); i++ {
+		data[i] = int(p[i])
+	}
+	return data
+}
+
+func fsCreate(name string) error {
+	return codeToError(createFile(name))
+}
+
+func fsDestroy(name string) error {
+	return codeToError(destroyFile(name))
+}
+
+// fsOpen opens a file with one of the modes r, w, rw or a and returns its handle
+func fsOpen(name string, mode string) (int, error) {
+	handle := openFile(name, mode, false, false)
+	if err := codeToError(handle); err != nil {
+		return -1, err
+	}
+	return handle, nil
+}
+
+// fsClose drops a reference like cl, a slot that a forked descriptor still refers to
+// stays open
+func fsClose(handle int) error {
+	if !releaseOFTEntry(handle) {
+		return errFS
+	}
+	return nil
+}
+
+func fsRead(handle int, p []byte) (int, error) {
+	data := make([]int, len(p))
+	n := readFromOFT(handle, data)
+	if err := codeToError(n); err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		p[i] = byte(data[i])
+	}
+	return n, nil
+}
+
+// fsWrite returns errDiskFull together with the bytes stored when the disk filled up
+func fsWrite(handle int, p []byte) (int, error) {
+	n, full := writeToOFT(handle, toInts(p))
+	if err := codeToError(n); err != nil {
+		return 0, err
+	}
+	if full {
+		return n, errDiskFull
+	}
+	return n, nil
+}
+
+func fsSeek(handle int, pos int) error {
+	return codeToError(seekOFT(handle, pos))
+}
+
+// fsDirectory returns the same listing as the dr command
+func fsDirectory() (string, error) {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	return buildDirectoryListing()
+}
+
+// fsReplace gives a file new contents, creating it when it is missing, and reports
+// whether it was created. The data goes into a spare descriptor that only replaces the
+// file's once all of it is written, so a failure leaves the old contents in place.
+func fsReplace(name string, p []byte) (bool, error) {
+	if len(p) > maxFileSize {
+		return false, errFS
+	}
+	data := toInts(p)
+	dirMu.Lock()
+	defer dirMu.Unlock()
+
+	descriptorIndx := searchDirectoryForFile(name)
+	if descriptorIndx == -1 {
+		descriptorIndx = createFileLocked(name)
+		if descriptorIndx < 0 {
+			return false, codeToError(descriptorIndx)
+		}
+		if !writeFileData(descriptorIndx, data) {
+			deleteDirectoryEntry(name)
+			writeDescriptor(descriptorIndx, [4]int{})
+			saveDirectoryToDisk()
+			return false, errDiskFull
+		}
+		return true, nil
+	}
+
+	if mountedSnapshot != "" {
+		return false, errFS
+	}
+	for i := 1; i < 4; i++ {
+		if oftValid[i] && oftVolume[i] == activeVolume && oftDescriptorIndex[i] == descriptorIndx {
+			return false, errFS
+		}
+	}
+	spare := findFreeDescriptor()
+	if spare == -1 {
+		return false, errFS
+	}
+	if !writeFileData(spare, data) {
+		writeDescriptor(spare, [4]int{})
+		return false, errDiskFull
+	}
+	desc, _ := readDescriptor(spare)
+	writeDescriptor(descriptorIndx, desc)
+	writeDescriptor(spare, [4]int{})
+	return false, nil
+}
+
+// fileInfo is one entry of fsList
+type fileInfo struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+// fsList returns the files in directory order
+func fsList() ([]fileInfo, error) {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	files := []fileInfo{}
+	for _, name := range directoryNames() {
+		desc, ok := readDescriptor(dirNameIndex[name].descriptor)
+		if !ok {
+			return nil, errFS
+		}
+		files = append(files, fileInfo{Name: name, Size: desc[0]})
+	}
+	return files, nil
+}
+
+// fsStat returns the size of a file
+func fsStat(name string) (int, error) {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	desc, ok := readDescriptor(searchDirectoryForFile(name))
+	if !ok {
+		return 0, errFS
+	}
+	return desc[0], nil
+}
+
+// fsReadFile returns the contents of a file as they are on the disk, like exp it needs
+// no OFT entry, so it works while the file is open for writing or the OFT is full
+func fsReadFile(name string) ([]byte, error) {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	descriptorIndx := searchDirectoryForFile(name)
+	if _, ok := readDescriptor(descriptorIndx); !ok {
+		return nil, errFS
+	}
+	data, ok := readFileData(descriptorIndx)
+	if !ok {
+		return nil, errChecksum
+	}
+	content := make([]byte, len(data))
+	for i := 0; i < len(data); i++ {
+		content[i] = byte(data[i])
+	}
+	return content, nil
+}
+
+// fsLock takes a shared ("sh") or exclusive ("ex") lock on the file behind handle.
+// owner identifies the caller for deadlock detection. With wait set it blocks until the
+// lock is granted, unless waiting would deadlock.
+func fsLock(owner int, handle int, mode string, wait bool) error {
+	if handle < 1 || handle >= 4 || (mode != "sh" && mode != "ex") {
+		return errFS
+	}
+
+	oftMu[handle].Lock()
+	if !oftValid[handle] {
+		oftMu[handle].Unlock()
+		return errFS
+	}
+	flockMu.Lock()
+	defer flockMu.Unlock()
+	status, req := requestLockLocked(owner, handle, -1, oftDescriptorIndex[handle], mode, wait)
+	oftMu[handle].Unlock()
+
+	if status == "busy" {
+		return errWouldBlock
+	}
+	if status == "deadlock" {
+		return errDeadlock
+	}
+	if status == "waiting" {
+		for !req.granted && !req.cancelled {
+			flockCond.Wait()
+		}
+		if req.cancelled {
+			return errFS
+		}
+	}
+	return nil
+}
+
+func fsUnlock(handle int) error {
+	if handle < 1 || handle >= 4 {
+		return errFS
+	}
+
+	oftMu[handle].Lock()
+	defer oftMu[handle].Unlock()
+	flockMu.Lock()
+	defer flockMu.Unlock()
+	if !oftValid[handle] || oftLockMode[handle] == "" {
+		return errFS
+	}
+	releaseLockLocked(handle, false)
+	return nil
+}
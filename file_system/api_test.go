@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentStress runs writers on separate files next to a goroutine churning the
+// directory, run it with -race to check the locking
+func TestConcurrentStress(t *testing.T) {
+	init_fs()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 3; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := "w" + strconv.Itoa(w)
+			for round := 0; round < 50; round++ {
+				if err := fsCreate(name); err != nil {
+					t.Errorf("create %s: %v", name, err)
+					return
+				}
+				h, err := fsOpen(name, "rw")
+				if err != nil {
+					t.Errorf("open %s: %v", name, err)
+					return
+				}
+
+				// span all three blocks so every round allocates
+				want := bytes.Repeat([]byte{byte('a' + w), byte(round)}, 700)
+				if n, err := fsWrite(h, want); err != nil || n != len(want) {
+					t.Errorf("write %s: %d %v", name, n, err)
+					return
+				}
+				if err := fsSeek(h, 0); err != nil {
+					t.Errorf("seek %s: %v", name, err)
+					return
+				}
+				got := make([]byte, len(want))
+				if n, err := fsRead(h, got); err != nil || n != len(want) {
+					t.Errorf("read %s: %d %v", name, n, err)
+					return
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s round %d read back different data", name, round)
+					return
+				}
+
+				if err := fsClose(h); err != nil {
+					t.Errorf("close %s: %v", name, err)
+					return
+				}
+				if err := fsDestroy(name); err != nil {
+					t.Errorf("destroy %s: %v", name, err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 200; round++ {
+			name := "c" + strconv.Itoa(round%10)
+			fsCreate(name)
+			fsDirectory()
+			fsDestroy(name)
+		}
+	}()
+	wg.Wait()
+
+	if listing, _ := fsDirectory(); listing != "" {
+		t.Errorf("directory not empty after stress: %q", listing)
+	}
+}
+
+func TestHandlesAreChecked(t *testing.T) {
+	init_fs()
+
+	if err := fsCreate("a"); err != nil {
+		t.Fatal(err)
+	}
+	h, err := fsOpen("a", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsWrite(h, []byte("x")); err == nil {
+		t.Error("write through a read-only handle succeeded")
+	}
+	if err := fsClose(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsClose(h); err == nil {
+		t.Error("closing a closed handle succeeded")
+	}
+	if _, err := fsRead(0, make([]byte, 1)); err == nil {
+		t.Error("reading the directory handle succeeded")
+	}
+}
+
+// TestCloseDropsOneReference closes a slot that two processes share, it stays open until
+// the second close
+func TestCloseDropsOneReference(t *testing.T) {
+	runScript(t, "in", "cr a", "op a rw", "fk")
+
+	if err := fsClose(1); err != nil {
+		t.Fatal(err)
+	}
+	if !oftValid[1] || oftRefCount[1] != 1 {
+		t.Fatalf("slot 1 valid %v refs %d after the first close", oftValid[1], oftRefCount[1])
+	}
+	if n, err := fsWrite(1, []byte("x")); n != 1 || err != nil {
+		t.Errorf("write after the first close: %d %v", n, err)
+	}
+	if err := fsClose(1); err != nil {
+		t.Fatal(err)
+	}
+	if oftValid[1] {
+		t.Error("slot 1 still open after the last close")
+	}
+}
+
+func TestLockBlocksAndDetectsDeadlock(t *testing.T) {
+	init_fs()
+
+	if err := fsCreate("a"); err != nil {
+		t.Fatal(err)
+	}
+	h1, err1 := fsOpen("a", "r")
+	h2, err2 := fsOpen("a", "r")
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if err := fsLock(1, h1, "sh", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsLock(2, h2, "sh", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsLock(2, h2, "ex", false); err != errWouldBlock {
+		t.Fatalf("non-blocking upgrade: got %v, want %v", err, errWouldBlock)
+	}
+
+	// owner 1 waits for owner 2 to drop its shared lock
+	done := make(chan error)
+	go func() {
+		done <- fsLock(1, h1, "ex", true)
+	}()
+	for waiting := 0; waiting == 0; {
+		flockMu.Lock()
+		waiting = len(lockWaiters)
+		flockMu.Unlock()
+	}
+
+	if err := fsLock(2, h2, "ex", true); err != errDeadlock {
+		t.Fatalf("crossed upgrade: got %v, want %v", err, errDeadlock)
+	}
+	if err := fsUnlock(h2); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("waiting lock: %v", err)
+	}
+
+	// closing the holder releases its lock
+	if err := fsClose(h1); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsLock(2, h2, "ex", false); err != nil {
+		t.Fatalf("lock after holder closed: %v", err)
+	}
+}
+
+// TestLocksAcrossProcesses takes and drops locks from several processes, a forked
+// descriptor shares the lock of its slot
+func TestLocksAcrossProcesses(t *testing.T) {
+	checkScript(t, []string{
+		"in", "cr a", "op a r", "sp", "sw 1", "op a r", "lk 1 sh", "sw 0", "lk 1 ex nb", "lk 1 sh", "fk",
+		"sw 2", "cl 1", "pt", "ex", "sw 1", "ul 1", "lk 1 ex nb", "ul 1", "ex", "sw 0", "lk 1 ex",
+		"ul 1", "pt", "sw 7",
+	}, []string{
+		"system initialized", "a created", "a opened 1", "process 1 spawned", "process 1 running",
+		"a opened 1", "1 locked sh", "process 0 running", "error", "1 locked sh", "process 2 forked",
+		"process 2 running", "1 closed", "slot 0 descriptor 0 position 0 size 8 block 0 mode rw refs 0",
+		"slot 1 descriptor 1 position 0 size 0 block 0 mode r refs 1",
+		"slot 2 descriptor 1 position 0 size 0 block 0 mode r refs 1", "slot 3 free", "process 2 exited",
+		"process 1 running", "1 unlocked", "error", "error", "process 1 exited", "process 0 running",
+		"1 locked ex", "1 unlocked", "slot 0 descriptor 0 position 0 size 8 block 0 mode rw refs 0",
+		"slot 1 descriptor 1 position 0 size 0 block 0 mode r refs 1", "slot 2 free", "slot 3 free",
+		"error",
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// TAR ARCHIVES
+//
+// tarx and tari move a whole directory in and out of a host file as a tar archive, a
+// format other tools read and write, unlike the raw disk image of sv and ld. An archive
+// holds one regular file per directory entry.
+
+// archive_files writes every file of the active volume to a tar archive at hostPath
+func archive_files(hostPath string) {
+	dirMu.Lock()
+	names := directoryNames()
+	descriptorIndexes := make([]int, len(names))
+	valid := true
+	for i, name := range names {
+		descriptorIndexes[i] = searchDirectoryForFile(name)
+		if _, ok := readDescriptor(descriptorIndexes[i]); !ok {
+			valid = false
+		}
+	}
+	dirMu.Unlock()
+	if !valid {
+		output = append(output, "error")
+		return
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for i, name := range names {
+		data, ok := readFileData(descriptorIndexes[i])
+		if !ok {
+			output = append(output, "checksum error")
+			return
+		}
+		content := make([]byte, len(data))
+		for j := 0; j < len(data); j++ {
+			content[j] = byte(data[j])
+		}
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg, Format: tar.FormatUSTAR}
+		if tw.WriteHeader(header) != nil {
+			output = append(output, "error")
+			return
+		}
+		if _, err := tw.Write(content); err != nil {
+			output = append(output, "error")
+			return
+		}
+	}
+	if tw.Close() != nil || os.WriteFile(hostPath, archive.Bytes(), 0644) != nil {
+		output = append(output, "error")
+		return
+	}
+	output = append(output, strconv.Itoa(len(names))+" files archived to "+hostPath)
+}
+
+// validArchiveName checks a name from an archive: one to three printable ASCII
+// characters that a command can name again and the directory reads back byte for byte,
+// so no space and no / that would read as a mount point
+func validArchiveName(name string) bool {
+	if name == "" || len(name) > 3 || strings.Contains(name, "/") {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 0x21 || name[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// readArchive returns the files of a tar archive in order. It fails on anything but
+// regular files with valid names that fit into a file, the directory entry for . that
+// tar adds for a whole directory is skipped.
+func readArchive(hostPath string) ([]string, [][]byte, bool) {
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer f.Close()
+
+	names := []string{}
+	contents := [][]byte{}
+	seen := make(map[string]bool)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names, contents, true
+		}
+		if err != nil {
+			return nil, nil, false
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if header.Typeflag == tar.TypeDir && (name == "" || name == ".") {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg || !validArchiveName(name) || seen[name] || header.Size > maxFileSize {
+			return nil, nil, false
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, false
+		}
+		seen[name] = true
+		names = append(names, name)
+		contents = append(contents, content)
+	}
+}
+
+// extract_files creates the files of a tar archive on the active volume. The archive is
+// checked as a whole first and a full disk undoes the files created so far, so either
+// every file is extracted or none. dirMu is held throughout, so no other client can
+// create one of the names in between or see a file before it is complete.
+func extract_files(hostPath string) {
+	names, contents, ok := readArchive(hostPath)
+	if !ok {
+		output = append(output, "error")
+		return
+	}
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	for _, name := range names {
+		if searchDirectoryForFile(name) != -1 {
+			output = append(output, "error")
+			return
+		}
+	}
+
+	created := []string{}
+	for i, name := range names {
+		descriptorIndx := createFileLocked(name)
+		if descriptorIndx >= 0 {
+			created = append(created, name)
+		}
+		data := make([]int, len(contents[i]))
+		for j := 0; j < len(contents[i]); j++ {
+			data[j] = int(contents[i][j])
+		}
+		if descriptorIndx < 0 || !writeFileData(descriptorIndx, data) {
+			for _, name := range created {
+				destroyFileLocked(name)
+			}
+			output = append(output, "error")
+			return
+		}
+	}
+	output = append(output, strconv.Itoa(len(names))+" files extracted from "+hostPath)
+}
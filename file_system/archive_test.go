@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeArchive builds a tar archive from headers, each regular file holding its name
+func writeArchive(t *testing.T, path string, headers ...*tar.Header) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(header.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTarArchives round-trips a directory through tarx and tari and checks that
+// archives breaking the naming rules are refused as a whole
+func TestTarArchives(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "files.tar")
+
+	out := runScript(t, "in", "cr a", "op a rw", "wm 0 hello", "wr 1 0 5", "sk 1 1000", "wr 1 0 5", "cl 1", "cr b", "tarx "+path)
+	if out[len(out)-1] != "2 files archived to "+path {
+		t.Fatalf("tarx: %q", out)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(f)
+	sizes := []int{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		if header.Name == "a" && (string(content[:5]) != "hello" || string(content[1000:]) != "hello") {
+			t.Errorf("content of a: %q", content)
+		}
+		sizes = append(sizes, len(content))
+	}
+	f.Close()
+	if len(sizes) != 2 || sizes[0] != 1005 || sizes[1] != 0 {
+		t.Errorf("archived sizes %v", sizes)
+	}
+
+	out = runScript(t, "in", "tari "+path, "dr", "op a r", "sk 1 1000", "rd 1 0 5", "rm 0 5", "tari "+path,
+		"mkdisk d 16", "mount d /d", "tari "+path+" /d", "dr /d")
+	want := []string{"system initialized", "2 files extracted from " + path, "a 1005 b 0", "a opened 1",
+		"position is 1000", "5 bytes read from 1", "hello", "error",
+		"disk d created with 16 blocks", "d mounted on /d", "2 files extracted from " + path, "a 1005 b 0"}
+	if strings.Join(out, "\n") != strings.Join(want, "\n") {
+		t.Errorf("tari:\n%s\nwant:\n%s", strings.Join(out, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the . entry and ./ prefixes of tar -C dir -cf x . are accepted
+	writeArchive(t, path, &tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./x", Typeflag: tar.TypeReg, Mode: 0644})
+	if out := runScript(t, "in", "tari "+path, "dr"); out[2] != "x 3" {
+		t.Errorf("dot entries: %q", out)
+	}
+
+	bad := map[string][]*tar.Header{
+		"long name":  {{Name: "abcd", Typeflag: tar.TypeReg}},
+		"path":       {{Name: "../a", Typeflag: tar.TypeReg}},
+		"space":      {{Name: "a b", Typeflag: tar.TypeReg}},
+		"non-ascii":  {{Name: "é", Typeflag: tar.TypeReg}},
+		"control":    {{Name: "a\x01", Typeflag: tar.TypeReg}},
+		"directory":  {{Name: "sub/", Typeflag: tar.TypeDir}},
+		"symlink":    {{Name: "ln", Typeflag: tar.TypeSymlink, Linkname: "a"}},
+		"duplicate":  {{Name: "a", Typeflag: tar.TypeReg}, {Name: "a", Typeflag: tar.TypeReg}},
+		"one of two": {{Name: "ok", Typeflag: tar.TypeReg}, {Name: "toolong", Typeflag: tar.TypeReg}},
+	}
+	for name, headers := range bad {
+		writeArchive(t, path, headers...)
+		if out := runScript(t, "in", "tari "+path, "dr"); out[1] != "error" || out[2] != "" {
+			t.Errorf("%s: %q", name, out)
+		}
+	}
+	os.WriteFile(path, []byte("not a tar archive"), 0644)
+	if out := runScript(t, "in", "tari "+path); out[1] != "error" {
+		t.Errorf("garbage: %q", out)
+	}
+}
+
+// TestTarExtractFullDisk extracts an archive whose second file does not fit, the first
+// is removed again and the files already on the disk stay
+func TestTarExtractFullDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.tar")
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range []string{"p", "q"} {
+		content := bytes.Repeat([]byte(name), 1000)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 18 files of three blocks leave two of the 56 data blocks, enough for p only
+	script := []string{"in"}
+	for i := 10; i < 28; i++ {
+		name := strconv.Itoa(i)
+		script = append(script, "cr "+name, "op "+name+" w", "wr 1 0 512", "wr 1 0 512", "wr 1 0 512", "cl 1")
+	}
+	out := runScript(t, append(script, "tari "+path, "st p", "st 27", "df")...)
+	want := []string{"error", "error", "27 size 1536 blocks 3", "blocks 56 used 54 free 2 largest free run 2",
+		"descriptors 191 used 18 free 173", "directory slots 192 used 18 free 174"}
+	if got := strings.Join(out[len(out)-len(want):], "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("output:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import "strconv"
+
+// DEFRAGMENT FUNCTIONS
+
+// packDescriptor places the blocks of desc one after another starting at next and
+// returns the new descriptor together with the first block after it
+func packDescriptor(desc [4]int, next int) ([4]int, int) {
+	if len(descriptorBlocks(desc)) == 0 {
+		return desc, next
+	}
+	if allocationMode == "extent" {
+		return [4]int{desc[0], next, desc[2], desc[3]}, next + desc[2]
+	}
+	packed := [4]int{desc[0], 0, 0, 0}
+	for i := 0; i < 3; i++ {
+		if desc[1+i] != 0 {
+			packed[1+i] = next
+			next++
+		}
+	}
+	return packed, next
+}
+
+// defrag moves the blocks of every file, in descriptor order, to the start of the
+// data area so each file is contiguous and in order. The moved blocks are staged in
+// memory first, so a block failing its checksum aborts before anything changes.
+// Open files stay coherent because OFT buffers hold file blocks, not disk blocks, and
+// writes already went through to disk.
+func defrag() {
+	if len(snapshots) > 0 || mountedSnapshot != "" {
+		// snapshots share blocks by disk number, moving them would corrupt the snapshot
+		output = append(output, "error")
+		return
+	}
+
+	_, fragmentsBefore := countFragments()
+
+	dirMu.Lock()
+	for i := 1; i < 4; i++ {
+		oftMu[i].Lock()
+	}
+	allocMu.Lock()
+
+	// the directory is packed first from block 7, which brings it back there if
+	// copy-on-write moved it, and the files follow it
+	var packed [192][4]int
+	staged := make(map[int][512]int)
+	moved := 0
+	ok := true
+	next := rootDirectoryBlock
+	for i := 0; i < 192 && ok; i++ {
+		packed[i], next = packDescriptor(descriptors[i], next)
+		if next < firstDataBlock {
+			next = firstDataBlock
+		}
+		for j := 0; j < 3; j++ {
+			from := physicalBlock(descriptors[i], j)
+			to := physicalBlock(packed[i], j)
+			if from == to {
+				continue
+			}
+			var block [512]int
+			if !readBlock(from, block[:]) {
+				ok = false
+				break
+			}
+			staged[to] = block
+			moved++
+		}
+	}
+
+	if ok {
+		for to, block := range staged {
+			writeBlock(to, block[:])
+		}
+		for i := 0; i < 192; i++ {
+			descriptors[i] = packed[i]
+		}
+	}
+
+	allocMu.Unlock()
+	for i := 3; i >= 1; i-- {
+		oftMu[i].Unlock()
+	}
+	dirMu.Unlock()
+
+	if !ok {
+		output = append(output, "checksum error")
+		return
+	}
+	_, fragmentsAfter := countFragments()
+	output = append(output, strconv.Itoa(moved)+" blocks moved, fragments before "+strconv.Itoa(fragmentsBefore)+" after "+strconv.Itoa(fragmentsAfter))
+}
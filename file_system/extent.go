@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// EXTENT ALLOCATION FUNCTIONS
+//
+// With "in extent" a descriptor holds a single run of contiguous blocks instead of
+// three block pointers: [size, first disk block, number of blocks, index of the file
+// block the run starts at]. A run that cannot grow in place is moved as a whole to a
+// free stretch that fits, so a file is always contiguous on disk.
+
+var allocationMode = "blocks"
+
+// block I/O counters, to compare how the two layouts use the disk
+var blockReads atomic.Int64
+var blockWrites atomic.Int64
+
+func resetIOCounts() {
+	blockReads.Store(0)
+	blockWrites.Store(0)
+}
+
+// findFreeRun returns the first block of length free blocks in a row, or -1
+func findFreeRun(usedBlocks map[int]bool, length int) int {
+	run := 0
+	for blockNum := firstDataBlock; blockNum < 64; blockNum++ {
+		if usedBlocks[blockNum] {
+			run = 0
+			continue
+		}
+		run++
+		if run == length {
+			return blockNum - length + 1
+		}
+	}
+	return -1
+}
+
+// allocateExtentBlock makes the run of a file cover block blockIndex and returns the
+// disk block now holding it, or -1. Blocks the run gains besides that one are zeroed,
+// the caller writes the returned block itself. It must be called with allocMu held.
+func allocateExtentBlock(descriptorIndx int, blockIndex int) int {
+	desc := descriptors[descriptorIndx]
+	usedBlocks := blocksInUse()
+	var block [512]int
+
+	if desc[1] == 0 {
+		start := findFreeRun(usedBlocks, 1)
+		if start < 0 {
+			return -1
+		}
+		descriptors[descriptorIndx] = [4]int{desc[0], start, 1, blockIndex}
+		return start
+	}
+
+	first := min(desc[3], blockIndex)
+	last := max(desc[3]+desc[2]-1, blockIndex)
+	length := last - first + 1
+
+	// grow in place when the run only needs the free blocks right after its end
+	if first == desc[3] && physicalBlock(desc, blockIndex) == 0 {
+		end := desc[1] + desc[2]
+		fits := desc[1]+length <= 64
+		for blockNum := end; fits && blockNum < desc[1]+length; blockNum++ {
+			if usedBlocks[blockNum] {
+				fits = false
+			}
+		}
+		if fits {
+			for blockNum := end; blockNum < desc[1]+length; blockNum++ {
+				if blockNum != desc[1]+blockIndex-first {
+					writeBlock(blockNum, block[:])
+				}
+			}
+			descriptors[descriptorIndx][2] = length
+			return desc[1] + blockIndex - first
+		}
+	}
+
+	// otherwise move the whole run, which also copies blocks a snapshot shares
+	start := findFreeRun(usedBlocks, length)
+	if start < 0 {
+		return -1
+	}
+	for i := first; i <= last; i++ {
+		if i == blockIndex {
+			continue
+		}
+		oldBlockNum := physicalBlock(desc, i)
+		if oldBlockNum != 0 {
+			if !readBlock(oldBlockNum, block[:]) {
+				return -1
+			}
+		} else {
+			block = [512]int{}
+		}
+		writeBlock(start+i-first, block[:])
+	}
+	descriptors[descriptorIndx] = [4]int{desc[0], start, length, first}
+	return start + blockIndex - first
+}
+
+// io_counts prints the block reads and writes since the last in
+func io_counts() {
+	output = append(output, strconv.FormatInt(blockReads.Load(), 10)+" block reads "+strconv.FormatInt(blockWrites.Load(), 10)+" block writes")
+}
+
+// countFragments returns how many files hold blocks and how many runs of consecutive
+// disk blocks those files are split into, equal numbers mean no fragmentation
+func countFragments() (int, int) {
+	files := 0
+	fragments := 0
+	for i := 1; i < 192; i++ {
+		desc, _ := readDescriptor(i)
+		blocks := descriptorBlocks(desc)
+		if len(blocks) == 0 {
+			continue
+		}
+		files++
+		fragments++
+		for j := 1; j < len(blocks); j++ {
+			if blocks[j] != blocks[j-1]+1 {
+				fragments++
+			}
+		}
+	}
+	return files, fragments
+}
+
+func fragmentation() {
+	files, fragments := countFragments()
+	output = append(output, strconv.Itoa(files)+" files in "+strconv.Itoa(fragments)+" fragments")
+}
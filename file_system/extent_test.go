@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+// TestExtentAllocation formats in extent mode, a write past the end moves the file to
+// a longer run
+func TestExtentAllocation(t *testing.T) {
+	checkScript(t, []string{
+		"in extent", "cr a", "cr b", "op a rw", "op b rw", "wm 0 hello", "wr 1 0 5", "wr 2 0 5",
+		"sk 1 600", "wr 1 0 5", "pd 1", "pd 2", "frag", "pm", "df", "cl 1", "cl 2", "defrag", "frag",
+		"pd 1", "pd 2", "op a r", "sk 1 600", "rd 1 20 5", "rm 20 5",
+	}, []string{
+		"system initialized", "a created", "b created", "a opened 1", "b opened 2",
+		"5 bytes written to M", "5 bytes written to 1", "5 bytes written to 2", "position is 600",
+		"5 bytes written to 1", "descriptor 1 size 605 start 10 length 2 first 0",
+		"descriptor 2 size 5 start 9 length 1 first 0", "2 files in 2 fragments", "00 -------d.###....",
+		"16 ................", "32 ................", "48 ................",
+		"blocks 56 used 3 free 53 largest free run 52", "descriptors 191 used 2 free 189",
+		"directory slots 192 used 2 free 190", "1 closed", "2 closed",
+		"3 blocks moved, fragments before 2 after 2", "2 files in 2 fragments",
+		"descriptor 1 size 605 start 8 length 2 first 0",
+		"descriptor 2 size 5 start 10 length 1 first 0", "a opened 1", "position is 600",
+		"5 bytes read from 1", "hello",
+	})
+}
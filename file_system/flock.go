@@ -0,0 +1,216 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// ADVISORY LOCK FUNCTIONS
+//
+// Locks work like flock: they belong to an OFT entry, an entry holds at most one lock
+// (sh or ex) on its file, and closing the entry drops it. Every request also names an
+// owner, the process in a script or a caller chosen id in the API, so that owners
+// waiting on each other in a cycle are reported as a deadlock instead of hanging.
+
+// lockRequest is a blocked lock request waiting for conflicting locks to go away
+type lockRequest struct {
+	owner     int
+	index     int
+	fd        int
+	mode      string
+	granted   bool
+	cancelled bool
+}
+
+// flockMu is a leaf lock, no other lock is taken while holding it
+var flockMu sync.Mutex
+var flockCond = sync.NewCond(&flockMu)
+var oftLockMode [4]string
+var oftLockOwner [4]int
+var oftLockFile [4]int
+var lockWaiters []*lockRequest
+
+// lockGrants collects requests from the script that were granted by someone else's
+// unlock or close, so the command that released them can report it
+var lockGrants []*lockRequest
+
+func resetLocks() {
+	flockMu.Lock()
+	defer flockMu.Unlock()
+	for i := 0; i < 4; i++ {
+		oftLockMode[i] = ""
+		oftLockOwner[i] = 0
+		oftLockFile[i] = -1
+	}
+	lockWaiters = nil
+	lockGrants = nil
+}
+
+// lockConflicts lists the owners whose locks stop index from taking mode on file
+func lockConflicts(index int, file int, mode string) []int {
+	var owners []int
+	for j := 1; j < 4; j++ {
+		if j == index || oftLockMode[j] == "" || oftLockFile[j] != file || oftVolume[j] != oftVolume[index] {
+			continue
+		}
+		if mode == "ex" || oftLockMode[j] == "ex" {
+			owners = append(owners, oftLockOwner[j])
+		}
+	}
+	return owners
+}
+
+// wouldDeadlock follows the owners blocking a request through the requests those
+// owners are waiting on, a path back to owner means nobody can ever continue
+func wouldDeadlock(owner int, blockers []int) bool {
+	visited := make(map[int]bool)
+	for len(blockers) > 0 {
+		b := blockers[len(blockers)-1]
+		blockers = blockers[:len(blockers)-1]
+		if b == owner {
+			return true
+		}
+		if visited[b] {
+			continue
+		}
+		visited[b] = true
+		for _, w := range lockWaiters {
+			if w.owner == b {
+				blockers = append(blockers, lockConflicts(w.index, oftLockFile[w.index], w.mode)...)
+			}
+		}
+	}
+	return false
+}
+
+// requestLockLocked takes or converts the lock of an OFT entry on file. It returns
+// "locked", "busy" when the lock conflicts and wait is false, "deadlock", or "waiting"
+// together with the queued request. flockMu must be held.
+func requestLockLocked(owner int, index int, fd int, file int, mode string, wait bool) (string, *lockRequest) {
+	oftLockFile[index] = file
+	blockers := lockConflicts(index, file, mode)
+	if len(blockers) == 0 {
+		oftLockMode[index] = mode
+		oftLockOwner[index] = owner
+		return "locked", nil
+	}
+	if !wait {
+		return "busy", nil
+	}
+	if wouldDeadlock(owner, blockers) {
+		return "deadlock", nil
+	}
+	req := &lockRequest{owner: owner, index: index, fd: fd, mode: mode}
+	lockWaiters = append(lockWaiters, req)
+	return "waiting", req
+}
+
+// releaseLockLocked drops the lock of an OFT entry, cancels its queued requests when
+// the entry is closing and grants whatever no longer conflicts. flockMu must be held.
+func releaseLockLocked(index int, closing bool) {
+	oftLockMode[index] = ""
+	oftLockOwner[index] = 0
+	if closing {
+		oftLockFile[index] = -1
+		remaining := lockWaiters[:0]
+		for _, w := range lockWaiters {
+			if w.index == index {
+				w.cancelled = true
+			} else {
+				remaining = append(remaining, w)
+			}
+		}
+		lockWaiters = remaining
+	}
+
+	for granted := true; granted; {
+		granted = false
+		for k, w := range lockWaiters {
+			if len(lockConflicts(w.index, oftLockFile[w.index], w.mode)) == 0 {
+				oftLockMode[w.index] = w.mode
+				oftLockOwner[w.index] = w.owner
+				w.granted = true
+				lockWaiters = append(lockWaiters[:k], lockWaiters[k+1:]...)
+				if w.fd >= 0 {
+					lockGrants = append(lockGrants, w)
+				}
+				granted = true
+				break
+			}
+		}
+	}
+	flockCond.Broadcast()
+}
+
+// releaseOFTLock is called by closeOFTEntry, which already holds the entry
+func releaseOFTLock(index int) {
+	flockMu.Lock()
+	defer flockMu.Unlock()
+	releaseLockLocked(index, true)
+}
+
+// reportLockGrants prints the waiting script requests that have since been granted
+func reportLockGrants() {
+	flockMu.Lock()
+	grants := lockGrants
+	lockGrants = nil
+	flockMu.Unlock()
+	for _, g := range grants {
+		output = append(output, strconv.Itoa(g.fd)+" locked "+g.mode+" in process "+strconv.Itoa(g.owner))
+	}
+}
+
+// lock_file locks the file behind a descriptor for the running process, a blocking
+// request that has to wait stays queued and is reported once it is granted
+func lock_file(fd int, mode string, wait bool) {
+	index := fdToOFT(fd)
+	if index == -1 || (mode != "sh" && mode != "ex") {
+		output = append(output, "error")
+		return
+	}
+
+	flockMu.Lock()
+	alreadyWaiting := false
+	for _, w := range lockWaiters {
+		if w.index == index {
+			alreadyWaiting = true
+		}
+	}
+	status := "busy"
+	if !alreadyWaiting {
+		status, _ = requestLockLocked(currentProc, index, fd, oftDescriptorIndex[index], mode, wait)
+	}
+	flockMu.Unlock()
+
+	if status == "locked" {
+		output = append(output, strconv.Itoa(fd)+" locked "+mode)
+	} else if status == "waiting" {
+		output = append(output, strconv.Itoa(fd)+" waiting")
+	} else if status == "deadlock" {
+		output = append(output, "deadlock detected")
+	} else {
+		output = append(output, "error")
+	}
+}
+
+func unlock_file(fd int) {
+	index := fdToOFT(fd)
+	if index == -1 {
+		output = append(output, "error")
+		return
+	}
+
+	flockMu.Lock()
+	held := oftLockMode[index] != ""
+	if held {
+		releaseLockLocked(index, false)
+	}
+	flockMu.Unlock()
+
+	if !held {
+		output = append(output, "error")
+		return
+	}
+	output = append(output, strconv.Itoa(fd)+" unlocked")
+	reportLockGrants()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hostCommands touch files outside the simulated disk, the fuzzer must not run them
+var hostCommands = map[string]bool{"sv": true, "ld": true, "imp": true, "exp": true, "tarx": true, "tari": true}
+
+// FuzzInterpreter runs arbitrary scripts, any input has to produce output lines and
+// never a panic
+func FuzzInterpreter(f *testing.F) {
+	scripts, _ := filepath.Glob(filepath.Join("testdata", "*.in"))
+	for _, script := range scripts {
+		input, err := os.ReadFile(script)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(input))
+	}
+	f.Add("in\ncr a\nop a rw\nsk 1 -1\nrd 1 -5 -1\nwr 1 511 2\nrm 9999999999999999999 1\ncl -1\n")
+	f.Add("rmx 9223372036854775807 9999999999\nrd 1 9223372036854775807 1\nwm 9223372036854775807 a\n")
+	f.Add("op a\ndr\nwr 1 0 1\nsp\nsw -1\ncb 64\ncb 8 512\nhd -1\npd 192\n")
+
+	f.Fuzz(func(t *testing.T, script string) {
+		defer func() { allocationMode = "blocks" }()
+		lines := []string{}
+		for _, line := range strings.Split(script, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && hostCommands[fields[0]] {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		if err := run(strings.NewReader(strings.Join(lines, "\n")), io.Discard); err != nil {
+			// only lines too long for the scanner end a script early
+			if !strings.Contains(err.Error(), "too long") {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+// FuzzLoadDisk loads arbitrary disk images. An image is either rejected as a whole or
+// leaves a file system every command can use. With fix set the block checksums are
+// recomputed first, so mutations get past the checksum test to the layout checks.
+func FuzzLoadDisk(f *testing.F) {
+	dir := f.TempDir()
+	path := filepath.Join(dir, "fuzz.disk")
+	setup := "in\ncr a\ncr b\nop a rw\nwm 0 hello\nwr 1 0 5\nsk 1 700\nwr 1 0 5\ncl 1\nsv " + path + "\n"
+	if err := run(strings.NewReader(setup), io.Discard); err != nil {
+		f.Fatal(err)
+	}
+	image, err := os.ReadFile(path)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(image, false)
+	f.Add(image, true)
+	f.Add(image[:512], false)
+	f.Add([]byte{}, false)
+
+	script := "in\nld " + path + "\ndr\ndf\npm\nfrag\nst a\nop a rw\nrd 1 0 512\nsk 1 1000\nwr 1 0 100\ncl 1\nde a\nde b\ncr c\ndefrag\n"
+	f.Fuzz(func(t *testing.T, image []byte, fix bool) {
+		defer func() { allocationMode = "blocks" }()
+		if fix && len(image) == 64*512 {
+			image = append([]byte{}, image...)
+			var block [512]int
+			for b := 1; b < 64; b++ {
+				for i := 0; i < 512; i++ {
+					block[i] = int(image[b*512+i])
+				}
+				sum := blockChecksum(block[:])
+				for i := 0; i < 4; i++ {
+					image[256+4*b+i] = byte(sum >> (24 - 8*i))
+				}
+			}
+		}
+		if err := os.WriteFile(path, image, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := run(strings.NewReader(script), io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
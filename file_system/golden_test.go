@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden .out files in testdata")
+
+// TestGolden runs every testdata/*.in script through the interpreter and compares the
+// output with the .out file next to it. Run with -update to accept new output.
+func TestGolden(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("testdata", "*.in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) == 0 {
+		t.Fatal("no scripts in testdata")
+	}
+	defer func() { allocationMode = "blocks" }()
+
+	for _, script := range scripts {
+		name := strings.TrimSuffix(filepath.Base(script), ".in")
+		t.Run(name, func(t *testing.T) {
+			input, err := os.ReadFile(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := run(bytes.NewReader(input), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			golden := strings.TrimSuffix(script, ".in") + ".out"
+			if *update {
+				if err := os.WriteFile(golden, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("output differs from %s\ngot:\n%s\nwant:\n%s", golden, got.Bytes(), want)
+			}
+		})
+	}
+}
+
+func runScript(t *testing.T, lines ...string) []string {
+	var out bytes.Buffer
+	if err := run(strings.NewReader(strings.Join(lines, "\n")), &out); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+}
+
+// checkScript runs a script and compares its output with want, for scripts that belong
+// with the tests of one command
+func checkScript(t *testing.T, script []string, want []string) {
+	t.Helper()
+	defer func() { allocationMode = "blocks" }()
+	got := runScript(t, script...)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
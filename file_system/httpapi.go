@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTP API
+//
+// newHTTPHandler serves the concurrent API as JSON endpoints, next to raw GET and PUT of
+// whole files:
+//
+//	GET    /files                  list, [{"name": "a", "size": 5}]
+//	POST   /files                  create, {"name": "a"}
+//	DELETE /files/{name}           destroy
+//	GET    /files/{name}           contents of a file
+//	PUT    /files/{name}           replace a file with the request body
+//	POST   /handles                open, {"name": "a", "mode": "rw"} gives {"handle": 1}
+//	DELETE /handles/{handle}       close
+//	POST   /handles/{handle}/read  {"count": 10} gives {"count": 5, "data": "<base64>"}
+//	POST   /handles/{handle}/write {"data": "<base64>"} gives {"count": 5}
+//	POST   /handles/{handle}/seek  {"position": 0}
+//
+// Errors come back as {"error": "..."}: 404 for a missing file, 409 when the file
+// system refuses an operation, 507 when the disk is full and 500 for a checksum error.
+// Handles are OFT entries, shared by every client like the file system itself.
+
+type httpFileRequest struct {
+	Name string `json:"name"`
+	Mode string `json:"mode"`
+}
+
+type httpIORequest struct {
+	Count    int    `json:"count"`
+	Data     []byte `json:"data"`
+	Position int    `json:"position"`
+}
+
+type httpResponse struct {
+	Name     string `json:"name,omitempty"`
+	Size     *int   `json:"size,omitempty"`
+	Handle   int    `json:"handle,omitempty"`
+	Count    *int   `json:"count,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	Position *int   `json:"position,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var errNoSuchFile = errors.New("no such file")
+
+// httpRoutes maps the method and the path with its last part replaced by {} to the
+// endpoint, the part goes to the endpoint as its argument. Routing by hand keeps the
+// server independent of the ServeMux pattern syntax of the Go version.
+var httpRoutes = map[string]func(http.ResponseWriter, *http.Request, string){
+	"GET /files":             httpList,
+	"POST /files":            httpCreate,
+	"DELETE /files/{}":       httpDestroy,
+	"GET /files/{}":          httpGetFile,
+	"PUT /files/{}":          httpPutFile,
+	"POST /handles":          httpOpen,
+	"DELETE /handles/{}":     httpClose,
+	"POST /handles/{}/read":  httpRead,
+	"POST /handles/{}/write": httpWrite,
+	"POST /handles/{}/seek":  httpSeek,
+}
+
+func newHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		arg := ""
+		if len(parts) > 1 {
+			arg = parts[1]
+			parts[1] = "{}"
+		}
+		endpoint := httpRoutes[r.Method+" /"+strings.Join(parts, "/")]
+		if endpoint == nil {
+			writeJSON(w, http.StatusNotFound, httpResponse{Error: "no such endpoint"})
+			return
+		}
+		endpoint(w, r, arg)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// httpFail answers with the status that matches err
+func httpFail(w http.ResponseWriter, err error) {
+	status := http.StatusConflict
+	switch err {
+	case errNoSuchFile:
+		status = http.StatusNotFound
+	case errDiskFull:
+		status = http.StatusInsufficientStorage
+	case errChecksum:
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, httpResponse{Error: err.Error()})
+}
+
+func badRequest(w http.ResponseWriter, message string) {
+	writeJSON(w, http.StatusBadRequest, httpResponse{Error: message})
+}
+
+// decodeBody reads a JSON request body into v, false after answering a bad request
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		badRequest(w, "invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// parseHandle parses the handle of the URL, false after answering a bad request
+func parseHandle(w http.ResponseWriter, arg string) (int, bool) {
+	handle, err := strconv.Atoi(arg)
+	if err != nil {
+		badRequest(w, "invalid handle")
+		return 0, false
+	}
+	return handle, true
+}
+
+func httpList(w http.ResponseWriter, r *http.Request, _ string) {
+	files, err := fsList()
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+func httpCreate(w http.ResponseWriter, r *http.Request, _ string) {
+	var req httpFileRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		badRequest(w, "missing name")
+		return
+	}
+	if err := fsCreate(req.Name); err != nil {
+		httpFail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, httpResponse{Name: req.Name})
+}
+
+func httpDestroy(w http.ResponseWriter, r *http.Request, name string) {
+	if _, err := fsStat(name); err != nil {
+		httpFail(w, errNoSuchFile)
+		return
+	}
+	if err := fsDestroy(name); err != nil {
+		httpFail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// httpGetFile reads a whole file straight from its blocks, without an OFT entry
+func httpGetFile(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := fsReadFile(name)
+	if err == errFS {
+		err = errNoSuchFile
+	}
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// httpPutFile replaces the contents of a file or creates it, a failed put leaves an
+// existing file as it was
+func httpPutFile(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFileSize))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, httpResponse{Error: "file too large"})
+		return
+	}
+
+	created, err := fsReplace(name, data)
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	n := len(data)
+	writeJSON(w, status, httpResponse{Name: name, Size: &n})
+}
+
+func httpOpen(w http.ResponseWriter, r *http.Request, _ string) {
+	req := httpFileRequest{Mode: "rw"}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if _, err := fsStat(req.Name); err != nil {
+		httpFail(w, errNoSuchFile)
+		return
+	}
+	handle, err := fsOpen(req.Name, req.Mode)
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, httpResponse{Handle: handle})
+}
+
+func httpClose(w http.ResponseWriter, r *http.Request, arg string) {
+	handle, ok := parseHandle(w, arg)
+	if !ok {
+		return
+	}
+	if err := fsClose(handle); err != nil {
+		httpFail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func httpRead(w http.ResponseWriter, r *http.Request, arg string) {
+	handle, ok := parseHandle(w, arg)
+	var req httpIORequest
+	if !ok || !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Count < 0 || req.Count > maxFileSize {
+		badRequest(w, "count out of range")
+		return
+	}
+	data := make([]byte, req.Count)
+	n, err := fsRead(handle, data)
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, httpResponse{Count: &n, Data: data[:n]})
+}
+
+// httpWrite reports how much was stored, also when the disk filled up
+func httpWrite(w http.ResponseWriter, r *http.Request, arg string) {
+	handle, ok := parseHandle(w, arg)
+	var req httpIORequest
+	if !ok || !decodeBody(w, r, &req) {
+		return
+	}
+	n, err := fsWrite(handle, req.Data)
+	if err == errDiskFull {
+		writeJSON(w, http.StatusInsufficientStorage, httpResponse{Count: &n, Error: err.Error()})
+		return
+	}
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, httpResponse{Count: &n})
+}
+
+func httpSeek(w http.ResponseWriter, r *http.Request, arg string) {
+	handle, ok := parseHandle(w, arg)
+	var req httpIORequest
+	if !ok || !decodeBody(w, r, &req) {
+		return
+	}
+	if err := fsSeek(handle, req.Position); err != nil {
+		httpFail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, httpResponse{Position: &req.Position})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// call sends a request and decodes a JSON reply into reply, it returns the status
+func call(t *testing.T, method string, url string, body string, reply any) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if reply != nil {
+		if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// TestHTTPAPI runs each endpoint once and then has clients replace and fetch files in
+// parallel, run it with -race
+func TestHTTPAPI(t *testing.T) {
+	init_fs()
+	server := httptest.NewServer(newHTTPHandler())
+	defer server.Close()
+	url := server.URL
+
+	var reply httpResponse
+	if status := call(t, "POST", url+"/files", `{"name": "a"}`, &reply); status != 201 || reply.Name != "a" {
+		t.Fatalf("create: %d %+v", status, reply)
+	}
+	if status := call(t, "POST", url+"/files", `{"name": "a"}`, nil); status != 409 {
+		t.Errorf("create twice: %d", status)
+	}
+
+	reply = httpResponse{}
+	if status := call(t, "POST", url+"/handles", `{"name": "a", "mode": "rw"}`, &reply); status != 201 || reply.Handle != 1 {
+		t.Fatalf("open: %d %+v", status, reply)
+	}
+	// "aGVsbG8gaHR0cA==" is "hello http"
+	if status := call(t, "POST", url+"/handles/1/write", `{"data": "aGVsbG8gaHR0cA=="}`, &reply); status != 200 || *reply.Count != 10 {
+		t.Fatalf("write: %d %+v", status, reply)
+	}
+	if status := call(t, "POST", url+"/handles/1/seek", `{"position": 6}`, nil); status != 200 {
+		t.Fatalf("seek: %d", status)
+	}
+	reply = httpResponse{}
+	if status := call(t, "POST", url+"/handles/1/read", `{"count": 100}`, &reply); status != 200 || string(reply.Data) != "http" {
+		t.Fatalf("read: %d %+v", status, reply)
+	}
+	if status := call(t, "DELETE", url+"/files/a", "", nil); status != 409 {
+		t.Errorf("destroyed an open file: %d", status)
+	}
+	if status := call(t, "DELETE", url+"/handles/1", "", nil); status != 204 {
+		t.Fatalf("close: %d", status)
+	}
+	if status := call(t, "DELETE", url+"/handles/1", "", nil); status != 409 {
+		t.Errorf("closed twice: %d", status)
+	}
+
+	if status := call(t, "PUT", url+"/files/b", strings.Repeat("b", 600), &reply); status != 201 || *reply.Size != 600 {
+		t.Fatalf("put: %d %+v", status, reply)
+	}
+	if status := call(t, "PUT", url+"/files/b", "short", &reply); status != 200 || *reply.Size != 5 {
+		t.Fatalf("put again: %d %+v", status, reply)
+	}
+	if status := call(t, "PUT", url+"/files/c", strings.Repeat("c", maxFileSize+1), nil); status != 413 {
+		t.Errorf("put too large: %d", status)
+	}
+	resp, err := http.Get(url + "/files/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "short" {
+		t.Errorf("get: %d %q", resp.StatusCode, body)
+	}
+	if status := call(t, "GET", url+"/files/zz", "", nil); status != 404 {
+		t.Errorf("get missing: %d", status)
+	}
+
+	var files []fileInfo
+	call(t, "GET", url+"/files", "", &files)
+	if len(files) != 2 || files[0] != (fileInfo{"a", 10}) || files[1] != (fileInfo{"b", 5}) {
+		t.Errorf("list: %+v", files)
+	}
+	if status := call(t, "DELETE", url+"/files/a", "", nil); status != 204 {
+		t.Errorf("destroy: %d", status)
+	}
+	if status := call(t, "DELETE", url+"/files/a", "", nil); status != 404 {
+		t.Errorf("destroy missing: %d", status)
+	}
+
+	// a put that fails leaves the old contents of b
+	call(t, "POST", url+"/handles", `{"name": "b", "mode": "r"}`, &reply)
+	if status := call(t, "PUT", url+"/files/b", "open", nil); status != 409 {
+		t.Errorf("put to an open file: %d", status)
+	}
+	// get needs no handle of its own, it works with every slot taken
+	handles := []int{reply.Handle}
+	for len(handles) < 3 {
+		call(t, "POST", url+"/handles", `{"name": "b", "mode": "r"}`, &reply)
+		handles = append(handles, reply.Handle)
+	}
+	resp, err = http.Get(url + "/files/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "short" {
+		t.Errorf("get with the OFT full: %d %q", resp.StatusCode, body)
+	}
+	for _, handle := range handles {
+		call(t, "DELETE", url+"/handles/"+strconv.Itoa(handle), "", nil)
+	}
+	fill := []string{}
+	for {
+		name := "f" + strconv.Itoa(len(fill))
+		if _, err := fsReplace(name, make([]byte, maxFileSize)); err != nil {
+			break
+		}
+		fill = append(fill, name)
+	}
+	if status := call(t, "PUT", url+"/files/b", strings.Repeat("b", maxFileSize), nil); status != 507 {
+		t.Errorf("put to a full disk: %d", status)
+	}
+	resp, err = http.Get(url + "/files/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "short" {
+		t.Errorf("b after failed puts: %q", body)
+	}
+	for _, name := range fill {
+		fsDestroy(name)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 3; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := "w" + strconv.Itoa(w)
+			for round := 0; round < 20; round++ {
+				want := bytes.Repeat([]byte{byte('a' + w), byte('0' + round%10)}, 300)
+				req, _ := http.NewRequest("PUT", url+"/files/"+name, bytes.NewReader(want))
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != 200 && resp.StatusCode != 201 {
+					t.Errorf("round %d of %s: put %d", round, name, resp.StatusCode)
+					return
+				}
+				resp, err = http.Get(url + "/files/" + name)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != 200 || !bytes.Equal(got, want) {
+					t.Errorf("round %d of %s: get %d, %d bytes", round, name, resp.StatusCode, len(got))
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
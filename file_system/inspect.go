@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// INSPECTION FUNCTIONS
+//
+// These print raw state for debugging scripts. The output only depends on the state
+// of the file system, so it can be kept in golden files.
+
+// dump_block prints a block as 32 lines of 16 hex bytes, during a transaction the
+// block as it will be written at commit
+func dump_block(blockNum int) {
+	if blockNum < 0 || blockNum >= diskBlocks {
+		output = append(output, "error")
+		return
+	}
+	block, buffered := bufferedBlock(blockNum)
+	if !buffered {
+		block = disk[blockNum]
+	}
+	for pos := 0; pos < 512; pos += 16 {
+		line := fmt.Sprintf("%03x:", pos)
+		for i := 0; i < 16; i++ {
+			line = line + fmt.Sprintf(" %02x", block[pos+i])
+		}
+		output = append(output, line)
+	}
+}
+
+// print_descriptor prints the size and block pointers, or the extent, of a descriptor
+func print_descriptor(descriptorIndx int) {
+	desc, ok := readDescriptor(descriptorIndx)
+	if !ok {
+		output = append(output, "error")
+		return
+	}
+	line := "descriptor " + strconv.Itoa(descriptorIndx) + " size " + strconv.Itoa(desc[0])
+	if allocationMode == "extent" {
+		line = line + " start " + strconv.Itoa(desc[1]) + " length " + strconv.Itoa(desc[2]) + " first " + strconv.Itoa(desc[3])
+	} else {
+		line = line + " blocks " + strconv.Itoa(desc[1]) + " " + strconv.Itoa(desc[2]) + " " + strconv.Itoa(desc[3])
+	}
+	output = append(output, line)
+}
+
+// volumeSuffix names the volume of an OFT entry when it is not the root volume
+func volumeSuffix(index int) string {
+	if index == 0 || oftVolume[index] == rootVolume {
+		return ""
+	}
+	return " volume " + oftVolume[index]
+}
+
+// print_oft prints one line per OFT entry
+func print_oft() {
+	for i := 0; i < 4; i++ {
+		if !oftValid[i] {
+			output = append(output, "slot "+strconv.Itoa(i)+" free")
+			continue
+		}
+		output = append(output, "slot "+strconv.Itoa(i)+
+			" descriptor "+strconv.Itoa(oftDescriptorIndex[i])+
+			" position "+strconv.Itoa(oftCurrentPosition[i])+
+			" size "+strconv.Itoa(oftFileSize[i])+
+			" block "+strconv.Itoa(oftLoadedBlock[i])+
+			" mode "+oftMode[i]+
+			" refs "+strconv.Itoa(oftRefCount[i])+
+			volumeSuffix(i))
+	}
+}
+
+// print_allocation_map prints rows of sixteen blocks up to the end of the disk:
+// - reserved, d directory, # file data, s held only by a snapshot, . free
+func print_allocation_map() {
+	var marks [64]byte
+	for b := 0; b < 64; b++ {
+		if b < firstDataBlock {
+			marks[b] = '-'
+		} else if blockRefCount[b] > 0 {
+			marks[b] = 's'
+		} else {
+			marks[b] = '.'
+		}
+	}
+	for i := 1; i < 192; i++ {
+		desc, _ := readDescriptor(i)
+		for _, blockNum := range descriptorBlocks(desc) {
+			marks[blockNum] = '#'
+		}
+	}
+	d0, _ := readDescriptor(0)
+	for _, blockNum := range descriptorBlocks(d0) {
+		marks[blockNum] = 'd'
+	}
+	for row := 0; row < diskBlocks; row += 16 {
+		output = append(output, fmt.Sprintf("%02d %s", row, marks[row:min(row+16, diskBlocks)]))
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var modelSeed = flag.Int64("seed", 0, "run the model test with this seed only")
+
+// modelOp is one step of a generated sequence. String gives it in input.txt syntax,
+// handles equal fds because a single process gets the lowest free fd and OFT slot.
+type modelOp struct {
+	kind   string // cr, de, op, cl, wr, rd or sk
+	name   string
+	mode   string
+	handle int
+	data   []byte
+	n      int // bytes to read or position to seek to
+}
+
+func (op modelOp) String() string {
+	h := strconv.Itoa(op.handle)
+	switch op.kind {
+	case "cr", "de":
+		return op.kind + " " + op.name
+	case "op":
+		return "op " + op.name + " " + op.mode
+	case "cl":
+		return "cl " + h
+	case "wr":
+		return "wm 0 " + string(op.data) + "\nwr " + h + " 0 " + strconv.Itoa(len(op.data))
+	case "rd":
+		return "rd " + h + " 0 " + strconv.Itoa(op.n) + "\nrm 0 " + strconv.Itoa(op.n)
+	}
+	return "sk " + h + " " + strconv.Itoa(op.n)
+}
+
+// refHandle and refFS are the reference: whole files as byte slices and OFT slots
+// holding only a name, a mode and a position
+type refHandle struct {
+	name string
+	mode string
+	pos  int
+}
+
+type refFS struct {
+	files   map[string][]byte
+	handles [4]*refHandle
+}
+
+func (m *refFS) isOpen(name string) bool {
+	for _, h := range m.handles {
+		if h != nil && h.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *refFS) apply(op modelOp) string {
+	var h *refHandle
+	if op.handle >= 1 && op.handle < 4 {
+		h = m.handles[op.handle]
+	}
+	switch op.kind {
+	case "cr":
+		if _, exists := m.files[op.name]; exists {
+			return "error"
+		}
+		m.files[op.name] = []byte{}
+		return "ok"
+	case "de":
+		if _, exists := m.files[op.name]; !exists || m.isOpen(op.name) {
+			return "error"
+		}
+		delete(m.files, op.name)
+		return "ok"
+	case "op":
+		if _, exists := m.files[op.name]; !exists {
+			return "error"
+		}
+		for _, other := range m.handles {
+			if other != nil && other.name == op.name && (op.mode != "r" || other.mode != "r") {
+				return "error"
+			}
+		}
+		for i := 1; i < 4; i++ {
+			if m.handles[i] == nil {
+				m.handles[i] = &refHandle{name: op.name, mode: op.mode}
+				return "ok " + strconv.Itoa(i)
+			}
+		}
+		return "error"
+	case "cl":
+		if h == nil {
+			return "error"
+		}
+		m.handles[op.handle] = nil
+		return "ok"
+	case "wr":
+		if h == nil || h.mode == "r" {
+			return "error"
+		}
+		content := m.files[h.name]
+		if h.mode == "a" {
+			h.pos = len(content)
+		}
+		n := len(op.data)
+		if n > 3*512-h.pos {
+			n = 3*512 - h.pos
+		}
+		// a write that stores nothing does not extend the file
+		if n > 0 {
+			for len(content) < h.pos+n {
+				content = append(content, 0)
+			}
+			copy(content[h.pos:], op.data[:n])
+			m.files[h.name] = content
+			h.pos += n
+		}
+		return "ok " + strconv.Itoa(n)
+	case "rd":
+		if h == nil || h.mode == "w" || h.mode == "a" {
+			return "error"
+		}
+		content := m.files[h.name]
+		if h.pos >= len(content) {
+			return "ok 0 "
+		}
+		n := len(content) - h.pos
+		if n > op.n {
+			n = op.n
+		}
+		got := content[h.pos : h.pos+n]
+		h.pos += n
+		return "ok " + strconv.Itoa(n) + " " + string(got)
+	}
+	if h == nil || op.n < 0 || op.n > 3*512 {
+		return "error"
+	}
+	h.pos = op.n
+	return "ok"
+}
+
+// applyToSimulator runs op through the API and words the result like refFS.apply
+func applyToSimulator(op modelOp) string {
+	var err error
+	switch op.kind {
+	case "cr":
+		err = fsCreate(op.name)
+	case "de":
+		err = fsDestroy(op.name)
+	case "op":
+		handle, err := fsOpen(op.name, op.mode)
+		if err != nil {
+			return "error"
+		}
+		return "ok " + strconv.Itoa(handle)
+	case "cl":
+		err = fsClose(op.handle)
+	case "wr":
+		n, err := fsWrite(op.handle, op.data)
+		if err != nil {
+			return "error"
+		}
+		return "ok " + strconv.Itoa(n)
+	case "rd":
+		buf := make([]byte, op.n)
+		n, err := fsRead(op.handle, buf)
+		if err != nil {
+			return "error"
+		}
+		return "ok " + strconv.Itoa(n) + " " + string(buf[:n])
+	default:
+		err = fsSeek(op.handle, op.n)
+	}
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// firstDivergence replays ops on a fresh disk and on the model and returns the index
+// of the first op whose results differ, or -1
+func firstDivergence(mode string, ops []modelOp) (int, string, string) {
+	allocationMode = mode
+	init_fs()
+	model := &refFS{files: make(map[string][]byte)}
+	for i, op := range ops {
+		got := applyToSimulator(op)
+		want := model.apply(op)
+		if got != want {
+			return i, got, want
+		}
+	}
+	return -1, "", ""
+}
+
+func generateOps(rng *rand.Rand, count int) []modelOp {
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	modes := []string{"r", "w", "rw", "rw", "a"}
+	kinds := []string{"cr", "de", "op", "op", "cl", "wr", "wr", "wr", "rd", "rd", "sk", "sk"}
+
+	ops := make([]modelOp, count)
+	for i := range ops {
+		op := modelOp{kind: kinds[rng.Intn(len(kinds))], name: names[rng.Intn(len(names))]}
+		op.mode = modes[rng.Intn(len(modes))]
+		op.handle = rng.Intn(4)
+		if rng.Intn(8) != 0 && op.handle == 0 {
+			op.handle = 1 + rng.Intn(3)
+		}
+		switch op.kind {
+		case "wr":
+			// the memory area limits one write to 512 bytes
+			size := 1 + rng.Intn(20)
+			if rng.Intn(3) == 0 {
+				size = 1 + rng.Intn(512)
+			}
+			op.data = make([]byte, size)
+			for j := range op.data {
+				op.data[j] = byte('a' + rng.Intn(26))
+			}
+		case "rd":
+			op.n = rng.Intn(513)
+		case "sk":
+			// favour block boundaries, they are where the OFT buffer changes
+			op.n = 512*rng.Intn(4) + rng.Intn(5) - 2
+			if rng.Intn(2) == 0 {
+				op.n = rng.Intn(3*512 + 1)
+			}
+		}
+		ops[i] = op
+	}
+	return ops
+}
+
+// shrink drops ops and shortens writes for as long as the sequence still diverges
+func shrink(mode string, ops []modelOp) []modelOp {
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(ops); i++ {
+			candidate := append(append([]modelOp{}, ops[:i]...), ops[i+1:]...)
+			if at, _, _ := firstDivergence(mode, candidate); at >= 0 {
+				ops = candidate[:at+1]
+				changed = true
+				i--
+			}
+		}
+		for i := 0; i < len(ops); i++ {
+			if ops[i].kind != "wr" || len(ops[i].data) == 1 {
+				continue
+			}
+			candidate := append([]modelOp{}, ops...)
+			candidate[i].data = ops[i].data[:len(ops[i].data)/2]
+			if at, _, _ := firstDivergence(mode, candidate); at >= 0 {
+				ops = candidate[:at+1]
+				changed = true
+			}
+		}
+	}
+	return ops
+}
+
+// brief cuts long read results down for the failure message
+func brief(result string) string {
+	if len(result) > 60 {
+		return result[:60] + "..."
+	}
+	return result
+}
+
+// TestModel compares random operation sequences on the simulator with the reference.
+// A failure prints the seed and a shrunk input.txt script that reproduces it.
+func TestModel(t *testing.T) {
+	defer func() { allocationMode = "blocks" }()
+
+	seeds := []int64{}
+	if *modelSeed != 0 {
+		seeds = append(seeds, *modelSeed)
+	} else {
+		for seed := int64(1); seed <= 200; seed++ {
+			seeds = append(seeds, seed)
+		}
+	}
+
+	for _, seed := range seeds {
+		mode := "blocks"
+		if seed%2 == 0 {
+			mode = "extent"
+		}
+		ops := generateOps(rand.New(rand.NewSource(seed)), 400)
+		at, _, _ := firstDivergence(mode, ops)
+		if at < 0 {
+			continue
+		}
+
+		ops = shrink(mode, ops[:at+1])
+		at, got, want := firstDivergence(mode, ops)
+		lines := []string{"in " + mode}
+		for _, op := range ops {
+			lines = append(lines, op.String())
+		}
+		t.Fatalf("seed %d diverges at step %d: simulator %q, model %q\n%s",
+			seed, at+1, brief(got), brief(want), strings.Join(lines, "\n"))
+	}
+}
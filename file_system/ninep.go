@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 9P SERVER
+//
+// serve9P exports the active volume over 9P2000, so the simulated disk can be explored
+// with standard 9P tools. The tree is flat, the root directory holds the files of the
+// directory. A fid opened on a file holds an OFT entry until it is clunked, so as with
+// the interpreter at most three files are open at once. Every connection is served by
+// its own goroutine and goes through the concurrent API.
+
+const (
+	p9Tversion = 100
+	p9Tauth    = 102
+	p9Tattach  = 104
+	p9Rerror   = 107
+	p9Tflush   = 108
+	p9Twalk    = 110
+	p9Topen    = 112
+	p9Tcreate  = 114
+	p9Tread    = 116
+	p9Twrite   = 118
+	p9Tclunk   = 120
+	p9Tremove  = 122
+	p9Tstat    = 124
+	p9Twstat   = 126
+)
+
+const p9MaxMsize = 8192
+const p9ReadHeader = 11 // size, type, tag and count of an Rread
+const p9QTDir = 0x80
+const p9DMDir = 0x80000000
+
+// open mode bits of Topen and Tcreate
+const (
+	p9OEXEC   = 3
+	p9OTRUNC  = 0x10
+	p9ORCLOSE = 0x40
+)
+
+var errNoFid = errors.New("unknown fid")
+var errFidInUse = errors.New("fid already in use")
+var errNotFound = errors.New("file not found")
+var errNotOpen = errors.New("fid not open")
+var errIsOpen = errors.New("fid already open")
+var errNotSupported = errors.New("operation not supported")
+var errMalformed = errors.New("malformed message")
+
+// p9Fid is a file of a connection, name is "" for the root directory
+type p9Fid struct {
+	name    string
+	open    bool
+	handle  int      // OFT entry of an open file
+	listing [][]byte // stat records of an open directory, read at offset 0
+	offsets []uint64 // offset of each record in listing
+}
+
+type p9Session struct {
+	msize uint32
+	fids  map[uint32]*p9Fid
+}
+
+// p9Reader decodes the little-endian fields of a message, short is set once it runs out
+type p9Reader struct {
+	data  []byte
+	short bool
+}
+
+func (r *p9Reader) take(n int) []byte {
+	if len(r.data) < n {
+		// zeros for the fixed size fields, strings and data come out empty
+		r.short = true
+		r.data = nil
+		return make([]byte, 8)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *p9Reader) u8() byte      { return r.take(1)[0] }
+func (r *p9Reader) u16() uint16   { return binary.LittleEndian.Uint16(r.take(2)) }
+func (r *p9Reader) u32() uint32   { return binary.LittleEndian.Uint32(r.take(4)) }
+func (r *p9Reader) u64() uint64   { return binary.LittleEndian.Uint64(r.take(8)) }
+func (r *p9Reader) str() string   { return string(r.take(int(r.u16()))) }
+func (r *p9Reader) bytes() []byte { return r.take(int(r.u32())) }
+
+func p9AppendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// p9Qid identifies a file by its descriptor, the root directory is descriptor 0
+func p9Qid(descriptor int) []byte {
+	qid := []byte{0}
+	if descriptor == 0 {
+		qid[0] = p9QTDir
+	}
+	qid = binary.LittleEndian.AppendUint32(qid, 0)
+	return binary.LittleEndian.AppendUint64(qid, uint64(descriptor))
+}
+
+// p9FileQid is the qid of a file or, for name "", of the root directory
+func p9FileQid(name string) []byte {
+	if name == "" {
+		return p9Qid(0)
+	}
+	descriptorIndx, _ := p9Lookup(name)
+	return p9Qid(max(descriptorIndx, 0))
+}
+
+// p9Lookup returns the descriptor and size of a file, or -1
+func p9Lookup(name string) (int, int) {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	descriptorIndx := searchDirectoryForFile(name)
+	desc, ok := readDescriptor(descriptorIndx)
+	if !ok {
+		return -1, 0
+	}
+	return descriptorIndx, desc[0]
+}
+
+// p9Stat encodes the stat record of a file or, for name "", of the root directory
+func p9Stat(name string) ([]byte, error) {
+	descriptorIndx, size := 0, 0
+	mode := uint32(p9DMDir | 0755)
+	statName := "/"
+	if name != "" {
+		descriptorIndx, size = p9Lookup(name)
+		if descriptorIndx == -1 {
+			return nil, errNotFound
+		}
+		mode = 0644
+		statName = name
+	}
+
+	var stat []byte
+	stat = binary.LittleEndian.AppendUint16(stat, 0) // type
+	stat = binary.LittleEndian.AppendUint32(stat, 0) // dev
+	stat = append(stat, p9Qid(descriptorIndx)...)
+	stat = binary.LittleEndian.AppendUint32(stat, mode)
+	stat = binary.LittleEndian.AppendUint32(stat, 0) // atime
+	stat = binary.LittleEndian.AppendUint32(stat, 0) // mtime
+	stat = binary.LittleEndian.AppendUint64(stat, uint64(size))
+	stat = p9AppendString(stat, statName)
+	stat = p9AppendString(stat, "fs")
+	stat = p9AppendString(stat, "fs")
+	stat = p9AppendString(stat, "")
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(len(stat))), stat...), nil
+}
+
+// listen9P listens on a Unix socket when addr is a path and on TCP otherwise
+func listen9P(addr string) (net.Listener, error) {
+	if strings.Contains(addr, "/") {
+		return net.Listen("unix", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serve9P accepts connections until the listener is closed, then waits for the open
+// connections to end
+func serve9P(l net.Listener) error {
+	var wg sync.WaitGroup
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			wg.Wait()
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve9PConn(conn)
+		}()
+	}
+}
+
+func serve9PConn(conn net.Conn) {
+	s := &p9Session{msize: p9MaxMsize, fids: make(map[uint32]*p9Fid)}
+	defer conn.Close()
+	defer s.clunkAll()
+
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		size := binary.LittleEndian.Uint32(header[:])
+		if size < 7 || size > s.msize {
+			return
+		}
+		message := make([]byte, size-4)
+		if _, err := io.ReadFull(conn, message); err != nil {
+			return
+		}
+
+		r := &p9Reader{data: message[3:]}
+		tag := binary.LittleEndian.Uint16(message[1:3])
+		rtype, reply, err := s.handle(message[0], r)
+		if err != nil {
+			rtype, reply = p9Rerror, p9AppendString(nil, err.Error())
+		}
+
+		response := binary.LittleEndian.AppendUint32(nil, uint32(7+len(reply)))
+		response = append(response, rtype)
+		response = binary.LittleEndian.AppendUint16(response, tag)
+		if _, err := conn.Write(append(response, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle runs one T-message and returns the type and body of the reply
+func (s *p9Session) handle(mtype byte, r *p9Reader) (byte, []byte, error) {
+	switch mtype {
+	case p9Tversion:
+		msize, version := r.u32(), r.str()
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		if msize <= p9ReadHeader {
+			return 0, nil, errors.New("msize too small")
+		}
+		s.clunkAll()
+		if msize < s.msize {
+			s.msize = msize
+		}
+		if !strings.HasPrefix(version, "9P2000") {
+			version = "unknown"
+		} else {
+			version = "9P2000"
+		}
+		return mtype + 1, p9AppendString(binary.LittleEndian.AppendUint32(nil, s.msize), version), nil
+	case p9Tauth:
+		return 0, nil, errors.New("authentication not required")
+	case p9Tattach:
+		fid := r.u32()
+		r.u32() // afid
+		r.str() // uname
+		r.str() // aname
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		if s.fids[fid] != nil {
+			return 0, nil, errFidInUse
+		}
+		s.fids[fid] = &p9Fid{}
+		return mtype + 1, p9Qid(0), nil
+	case p9Tflush:
+		// requests are answered in order, nothing is ever pending
+		r.u16()
+		return mtype + 1, nil, nil
+	case p9Twalk:
+		fid, newfid, count := r.u32(), r.u32(), int(r.u16())
+		names := make([]string, 0, count)
+		for i := 0; i < count && !r.short; i++ {
+			names = append(names, r.str())
+		}
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		return s.walk(fid, newfid, names)
+	case p9Topen:
+		fid, mode := r.u32(), r.u8()
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		f := s.fids[fid]
+		if f == nil {
+			return 0, nil, errNoFid
+		}
+		if err := s.open(f, mode); err != nil {
+			return 0, nil, err
+		}
+		return mtype + 1, binary.LittleEndian.AppendUint32(p9FileQid(f.name), 0), nil
+	case p9Tcreate:
+		fid, name, perm, mode := r.u32(), r.str(), r.u32(), r.u8()
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		return s.create(fid, name, perm, mode)
+	case p9Tread:
+		fid, offset, count := r.u32(), r.u64(), r.u32()
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		data, err := s.read(fid, offset, min(count, s.msize-p9ReadHeader))
+		if err != nil {
+			return 0, nil, err
+		}
+		return mtype + 1, append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...), nil
+	case p9Twrite:
+		fid, offset, data := r.u32(), r.u64(), r.bytes()
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		n, err := s.write(fid, offset, data)
+		if err != nil {
+			return 0, nil, err
+		}
+		return mtype + 1, binary.LittleEndian.AppendUint32(nil, uint32(n)), nil
+	case p9Tclunk:
+		fid := r.u32()
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		if s.fids[fid] == nil {
+			return 0, nil, errNoFid
+		}
+		s.clunk(fid)
+		return mtype + 1, nil, nil
+	case p9Tremove:
+		fid := r.u32()
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		f := s.fids[fid]
+		if f == nil {
+			return 0, nil, errNoFid
+		}
+		// the fid is clunked even when the remove fails
+		s.clunk(fid)
+		if f.name == "" {
+			return 0, nil, errNotSupported
+		}
+		if err := fsDestroy(f.name); err != nil {
+			return 0, nil, err
+		}
+		return mtype + 1, nil, nil
+	case p9Tstat:
+		fid := r.u32()
+		if r.short {
+			return 0, nil, errMalformed
+		}
+		f := s.fids[fid]
+		if f == nil {
+			return 0, nil, errNoFid
+		}
+		stat, err := p9Stat(f.name)
+		if err != nil {
+			return 0, nil, err
+		}
+		return mtype + 1, append(binary.LittleEndian.AppendUint16(nil, uint16(len(stat))), stat...), nil
+	case p9Twstat:
+		return 0, nil, errNotSupported
+	}
+	return 0, nil, errors.New("unknown message type")
+}
+
+// walk follows names from fid, the root is the only directory so a walk past a file stops
+func (s *p9Session) walk(fid uint32, newfid uint32, names []string) (byte, []byte, error) {
+	f := s.fids[fid]
+	if f == nil {
+		return 0, nil, errNoFid
+	}
+	if f.open {
+		return 0, nil, errIsOpen
+	}
+	if newfid != fid && s.fids[newfid] != nil {
+		return 0, nil, errFidInUse
+	}
+
+	name := f.name
+	qids := [][]byte{}
+	for _, next := range names {
+		if name != "" {
+			break
+		}
+		if next == ".." {
+			qids = append(qids, p9Qid(0))
+			continue
+		}
+		descriptorIndx, _ := p9Lookup(next)
+		if descriptorIndx == -1 {
+			break
+		}
+		name = next
+		qids = append(qids, p9Qid(descriptorIndx))
+	}
+	if len(names) > 0 && len(qids) == 0 {
+		return 0, nil, errNotFound
+	}
+	if len(qids) == len(names) {
+		s.fids[newfid] = &p9Fid{name: name}
+	}
+
+	reply := binary.LittleEndian.AppendUint16(nil, uint16(len(qids)))
+	for _, qid := range qids {
+		reply = append(reply, qid...)
+	}
+	return p9Twalk + 1, reply, nil
+}
+
+// open claims an OFT entry for a file fid, the simulator has no truncation
+func (s *p9Session) open(f *p9Fid, mode byte) error {
+	if f.open {
+		return errIsOpen
+	}
+	if mode&p9ORCLOSE != 0 {
+		return errNotSupported
+	}
+	if f.name == "" {
+		if mode&3 != 0 && mode&3 != p9OEXEC {
+			return errFS
+		}
+		f.open = true
+		return nil
+	}
+	if _, size := p9Lookup(f.name); mode&p9OTRUNC != 0 && size > 0 {
+		return errNotSupported
+	}
+
+	fileMode := []string{"r", "w", "rw", "r"}[mode&3]
+	handle, err := fsOpen(f.name, fileMode)
+	if err != nil {
+		return err
+	}
+	f.open = true
+	f.handle = handle
+	return nil
+}
+
+func (s *p9Session) create(fid uint32, name string, perm uint32, mode byte) (byte, []byte, error) {
+	f := s.fids[fid]
+	if f == nil {
+		return 0, nil, errNoFid
+	}
+	if f.name != "" || f.open {
+		return 0, nil, errFS
+	}
+	if perm&p9DMDir != 0 || name == "." || name == ".." {
+		return 0, nil, errNotSupported
+	}
+	if err := fsCreate(name); err != nil {
+		return 0, nil, err
+	}
+
+	file := &p9Fid{name: name}
+	if err := s.open(file, mode); err != nil {
+		return 0, nil, err
+	}
+	s.fids[fid] = file
+	return p9Tcreate + 1, binary.LittleEndian.AppendUint32(p9FileQid(name), 0), nil
+}
+
+func (s *p9Session) read(fid uint32, offset uint64, count uint32) ([]byte, error) {
+	f := s.fids[fid]
+	if f == nil {
+		return nil, errNoFid
+	}
+	if !f.open {
+		return nil, errNotOpen
+	}
+	if f.name == "" {
+		return s.readDirectory(f, offset, count)
+	}
+	if offset >= 3*512 {
+		return nil, nil
+	}
+	if err := fsSeek(f.handle, int(offset)); err != nil {
+		return nil, err
+	}
+	data := make([]byte, count)
+	n, err := fsRead(f.handle, data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// readDirectory returns whole stat records. Offset 0 takes a new listing, any other
+// offset has to be where an earlier read of it ended.
+func (s *p9Session) readDirectory(f *p9Fid, offset uint64, count uint32) ([]byte, error) {
+	if offset == 0 {
+		f.listing, f.offsets = nil, nil
+		files, err := fsList()
+		if err != nil {
+			return nil, err
+		}
+		next := uint64(0)
+		for _, file := range files {
+			// a file destroyed since the listing was taken is left out
+			if stat, err := p9Stat(file.Name); err == nil {
+				f.listing = append(f.listing, stat)
+				f.offsets = append(f.offsets, next)
+				next += uint64(len(stat))
+			}
+		}
+	}
+
+	first := sort.Search(len(f.offsets), func(i int) bool { return f.offsets[i] >= offset })
+	if first < len(f.offsets) && f.offsets[first] != offset {
+		return nil, errors.New("bad directory offset")
+	}
+	data := []byte{}
+	for i := first; i < len(f.listing) && len(data)+len(f.listing[i]) <= int(count); i++ {
+		data = append(data, f.listing[i]...)
+	}
+	return data, nil
+}
+
+// write stores data at offset, a disk that fills up gives a short write
+func (s *p9Session) write(fid uint32, offset uint64, data []byte) (int, error) {
+	f := s.fids[fid]
+	if f == nil {
+		return 0, errNoFid
+	}
+	if !f.open || f.name == "" {
+		return 0, errNotOpen
+	}
+	if offset > 3*512 {
+		return 0, errFS
+	}
+	if err := fsSeek(f.handle, int(offset)); err != nil {
+		return 0, err
+	}
+	n, err := fsWrite(f.handle, data)
+	if err == errDiskFull && n > 0 {
+		return n, nil
+	}
+	return n, err
+}
+
+func (s *p9Session) clunk(fid uint32) {
+	f := s.fids[fid]
+	if f.open && f.name != "" {
+		fsClose(f.handle)
+	}
+	delete(s.fids, fid)
+}
+
+// clunkAll closes the files of a connection that ends or starts over with Tversion
+func (s *p9Session) clunkAll() {
+	for fid := range s.fids {
+		s.clunk(fid)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// p9Client is just enough of a 9P2000 client to test the server, one request at a time
+type p9Client struct {
+	conn net.Conn
+	tag  uint16
+}
+
+func (c *p9Client) rpc(mtype byte, body []byte) (*p9Reader, error) {
+	c.tag++
+	message := binary.LittleEndian.AppendUint32(nil, uint32(7+len(body)))
+	message = append(message, mtype)
+	message = binary.LittleEndian.AppendUint16(message, c.tag)
+	if _, err := c.conn.Write(append(message, body...)); err != nil {
+		return nil, err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.LittleEndian.Uint32(header[:])-4)
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		return nil, err
+	}
+	r := &p9Reader{data: reply[3:]}
+	if binary.LittleEndian.Uint16(reply[1:3]) != c.tag {
+		return nil, errors.New("reply to another tag")
+	}
+	if reply[0] == p9Rerror {
+		return nil, errors.New(r.str())
+	}
+	if reply[0] != mtype+1 {
+		return nil, errors.New("unexpected reply type " + strconv.Itoa(int(reply[0])))
+	}
+	return r, nil
+}
+
+func (c *p9Client) version() (string, error) {
+	r, err := c.rpc(p9Tversion, p9AppendString(binary.LittleEndian.AppendUint32(nil, 8192), "9P2000"))
+	if err != nil {
+		return "", err
+	}
+	r.u32()
+	return r.str(), nil
+}
+
+func (c *p9Client) attach(fid uint32) error {
+	body := binary.LittleEndian.AppendUint32(nil, fid)
+	body = binary.LittleEndian.AppendUint32(body, ^uint32(0))
+	body = p9AppendString(p9AppendString(body, "user"), "")
+	_, err := c.rpc(p9Tattach, body)
+	return err
+}
+
+// walk returns the number of names walked
+func (c *p9Client) walk(fid uint32, newfid uint32, names ...string) (int, error) {
+	body := binary.LittleEndian.AppendUint32(nil, fid)
+	body = binary.LittleEndian.AppendUint32(body, newfid)
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(names)))
+	for _, name := range names {
+		body = p9AppendString(body, name)
+	}
+	r, err := c.rpc(p9Twalk, body)
+	if err != nil {
+		return 0, err
+	}
+	return int(r.u16()), nil
+}
+
+func (c *p9Client) open(fid uint32, mode byte) error {
+	_, err := c.rpc(p9Topen, append(binary.LittleEndian.AppendUint32(nil, fid), mode))
+	return err
+}
+
+func (c *p9Client) create(fid uint32, name string, perm uint32, mode byte) error {
+	body := p9AppendString(binary.LittleEndian.AppendUint32(nil, fid), name)
+	body = binary.LittleEndian.AppendUint32(body, perm)
+	_, err := c.rpc(p9Tcreate, append(body, mode))
+	return err
+}
+
+func (c *p9Client) read(fid uint32, offset uint64, count uint32) ([]byte, error) {
+	body := binary.LittleEndian.AppendUint32(nil, fid)
+	body = binary.LittleEndian.AppendUint64(body, offset)
+	r, err := c.rpc(p9Tread, binary.LittleEndian.AppendUint32(body, count))
+	if err != nil {
+		return nil, err
+	}
+	return r.bytes(), nil
+}
+
+func (c *p9Client) write(fid uint32, offset uint64, data []byte) (int, error) {
+	body := binary.LittleEndian.AppendUint32(nil, fid)
+	body = binary.LittleEndian.AppendUint64(body, offset)
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	r, err := c.rpc(p9Twrite, append(body, data...))
+	if err != nil {
+		return 0, err
+	}
+	return int(r.u32()), nil
+}
+
+func (c *p9Client) clunk(fid uint32) error {
+	_, err := c.rpc(p9Tclunk, binary.LittleEndian.AppendUint32(nil, fid))
+	return err
+}
+
+func (c *p9Client) remove(fid uint32) error {
+	_, err := c.rpc(p9Tremove, binary.LittleEndian.AppendUint32(nil, fid))
+	return err
+}
+
+// parseStat decodes a stat record into its name and length
+func parseStat(r *p9Reader) (string, uint64) {
+	r.u16() // size
+	r.take(2 + 4 + 13 + 4 + 4 + 4)
+	length := r.u64()
+	name := r.str()
+	r.str()
+	r.str()
+	r.str()
+	return name, length
+}
+
+func (c *p9Client) stat(fid uint32) (string, uint64, error) {
+	r, err := c.rpc(p9Tstat, binary.LittleEndian.AppendUint32(nil, fid))
+	if err != nil {
+		return "", 0, err
+	}
+	r.u16()
+	name, length := parseStat(r)
+	return name, length, nil
+}
+
+func dial9P(t *testing.T, addr string) *p9Client {
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &p9Client{conn: conn}
+	if version, err := c.version(); err != nil || version != "9P2000" {
+		t.Fatalf("version %q %v", version, err)
+	}
+	if err := c.attach(1); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestNinePServer drives the server with the test client and checks the results
+// through the API
+func TestNinePServer(t *testing.T) {
+	init_fs()
+	if err := fsCreate("sd"); err != nil {
+		t.Fatal(err)
+	}
+	handle, _ := fsOpen("sd", "w")
+	fsWrite(handle, []byte("planted"))
+	fsClose(handle)
+
+	addr := filepath.Join(t.TempDir(), "fs.sock")
+	listener, err := listen9P(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- serve9P(listener) }()
+	c := dial9P(t, addr)
+
+	// read a file made through the API
+	if n, err := c.walk(1, 2, "sd"); err != nil || n != 1 {
+		t.Fatalf("walk sd: %d %v", n, err)
+	}
+	if err := c.open(2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.read(2, 0, 100); err != nil || string(data) != "planted" {
+		t.Fatalf("read sd: %q %v", data, err)
+	}
+	if name, length, err := c.stat(2); err != nil || name != "sd" || length != 7 {
+		t.Fatalf("stat sd: %s %d %v", name, length, err)
+	}
+	if err := c.open(2, 0); err == nil {
+		t.Error("opened a fid twice")
+	}
+	c.clunk(2)
+	if _, err := c.walk(1, 3, "missing"); err == nil {
+		t.Error("walked to a missing file")
+	}
+	if n, err := c.walk(1, 3, "sd", "dp"); err != nil || n != 1 {
+		t.Errorf("walk past a file: %d %v", n, err)
+	}
+
+	// create a file spanning two blocks and find it in the simulator
+	c.walk(1, 4)
+	if err := c.create(4, "new", 0644, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.write(4, 0, []byte("hello 9p")); err != nil || n != 8 {
+		t.Fatalf("write: %d %v", n, err)
+	}
+	if n, err := c.write(4, 600, []byte("x")); err != nil || n != 1 {
+		t.Fatalf("write at 600: %d %v", n, err)
+	}
+	if data, err := c.read(4, 6, 2); err != nil || string(data) != "9p" {
+		t.Fatalf("read back: %q %v", data, err)
+	}
+	c.clunk(4)
+	if got, _ := fsDirectory(); got != "sd 7 new 601" {
+		t.Fatalf("directory %q", got)
+	}
+
+	// list the root directory, the second read starts where the first ended
+	c.walk(1, 5)
+	if err := c.open(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	listing, err := c.read(5, 0, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &p9Reader{data: listing}
+	names := []string{}
+	for len(r.data) > 0 && !r.short {
+		name, _ := parseStat(r)
+		names = append(names, name)
+	}
+	if len(names) != 2 || names[0] != "sd" || names[1] != "new" {
+		t.Errorf("listing %q", names)
+	}
+	if rest, err := c.read(5, uint64(len(listing)), 8192); err != nil || len(rest) != 0 {
+		t.Errorf("listing continues: %d %v", len(rest), err)
+	}
+	c.clunk(5)
+
+	// truncating is not supported, removing works and clunks the fid
+	c.walk(1, 6, "new")
+	if err := c.open(6, 2|p9OTRUNC); err == nil {
+		t.Error("truncated a file")
+	}
+	if err := c.remove(6); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.clunk(6); err == nil {
+		t.Error("fid survived remove")
+	}
+	if got, _ := fsDirectory(); got != "sd 7" {
+		t.Fatalf("directory after remove %q", got)
+	}
+
+	// every connection has its own fids, their open files are closed when it ends
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		c := dial9P(t, addr)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			defer c.conn.Close()
+			name := "c" + strconv.Itoa(w)
+			c.walk(1, 2)
+			if err := c.create(2, name, 0644, 2); err != nil {
+				t.Errorf("create %s: %v", name, err)
+				return
+			}
+			want := bytes.Repeat([]byte{byte('a' + w)}, 700)
+			for round := 0; round < 20; round++ {
+				c.write(2, 0, want)
+				if got, err := c.read(2, 0, 1000); err != nil || !bytes.Equal(got, want) {
+					t.Errorf("round %d of %s: %d bytes, %v", round, name, len(got), err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// the server is done with the file system once every connection has ended
+	c.conn.Close()
+	listener.Close()
+	<-served
+}
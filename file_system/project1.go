@@ -2,10 +2,18 @@ package main
 
 import (
 	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // globals
@@ -18,6 +26,22 @@ var oftFileSize [4]int
 var oftDescriptorIndex [4]int
 var oftValid [4]bool
 var oftLoadedBlock [4]int
+var oftMode [4]string
+var oftRefCount [4]int
+var procValid [8]bool
+var procFD [8][8]int
+var currentProc int
+
+// returned by the core operations in place of -1 when a block fails its checksum
+const checksumError = -2
+
+// locks, always taken in this order: dirMu, then oftMu of an entry, then allocMu
+var dirMu sync.Mutex
+var oftMu [4]sync.Mutex
+var allocMu sync.Mutex
+
+// number of snapshots referring to each block, a referenced block is never written again
+var blockRefCount [64]int
 var memory [512]int
 var output []string
 
@@ -34,10 +58,11 @@ func convertIntegerToBytes(val int, buffer []int, pos int) {
 	buffer[pos+3] = val % 256
 }
 
-func getFileNameAtPosition(pos int) string {
+// getFileNameAtPosition reads the name of the entry at offset pos of a directory block
+func getFileNameAtPosition(block []int, pos int) string {
 	name := ""
 	for i := 0; i < 4; i++ {
-		c := oftBuffer[0][pos+i]
+		c := block[pos+i]
 		if c != 0 {
 			name = name + string(rune(c))
 		}
@@ -45,87 +70,182 @@ func getFileNameAtPosition(pos int) string {
 	return name
 }
 
-func searchDirectoryForFile(filename string) int {
+// a file has at most three blocks, the directory is a file like any other and may use
+// all of them
+const maxFileSize = 3 * 512
+const maxDirectorySize = maxFileSize
+
+// directory index, rebuilt whenever the directory is loaded and kept up to date by
+// insertDirectoryEntry and deleteDirectoryEntry, so lookups do not scan the entries.
+// Guarded by dirMu like the directory itself.
+type directoryEntry struct {
+	descriptor int
+	pos        int
+}
+
+var dirNameIndex = make(map[string]directoryEntry)
+var dirEntryIndex = make(map[int]int) // descriptor to position of its entry
+
+// rebuildDirectoryIndex reads every directory block straight from disk, leaving the
+// block in the OFT buffer alone. It returns false with an empty index when a block
+// fails its checksum.
+func rebuildDirectoryIndex() bool {
+	dirNameIndex = make(map[string]directoryEntry)
+	dirEntryIndex = make(map[int]int)
 	dirSize := oftFileSize[0]
-	for pos := 0; pos < dirSize; pos += 8 {
-		name := getFileNameAtPosition(pos)
-		if name == filename {
-			index := convertBytesToInteger(oftBuffer[0][pos+4], oftBuffer[0][pos+5], oftBuffer[0][pos+6], oftBuffer[0][pos+7])
-			return index
+	d0, _ := readDescriptor(0)
+	var block [512]int
+	for start := 0; start < dirSize; start += 512 {
+		blockNum := physicalBlock(d0, start/512)
+		if blockNum == 0 {
+			continue
+		}
+		if !readBlock(blockNum, block[:]) {
+			dirNameIndex = make(map[string]directoryEntry)
+			dirEntryIndex = make(map[int]int)
+			return false
+		}
+		for pos := start; pos < start+512 && pos < dirSize; pos += 8 {
+			offset := pos % 512
+			name := getFileNameAtPosition(block[:], offset)
+			if name == "" {
+				continue
+			}
+			// a damaged directory may repeat a name, lookups always found the first
+			if _, seen := dirNameIndex[name]; seen {
+				continue
+			}
+			index := convertBytesToInteger(block[offset+4], block[offset+5], block[offset+6], block[offset+7])
+			dirNameIndex[name] = directoryEntry{index, pos}
+			if _, seen := dirEntryIndex[index]; !seen {
+				dirEntryIndex[index] = pos
+			}
 		}
 	}
-	return -1
+	return true
+}
+
+// directoryOffset switches the directory OFT entry to the block holding pos, the same
+// way read and write switch blocks, and returns the offset of pos in the buffer
+func directoryOffset(pos int) (int, bool) {
+	blockIndex := pos / 512
+	if blockIndex != oftLoadedBlock[0] && !loadFileBlockIntoBuffer(0, blockIndex) {
+		return 0, false
+	}
+	return pos % 512, true
 }
 
+func searchDirectoryForFile(filename string) int {
+	entry, exists := dirNameIndex[filename]
+	if !exists {
+		return -1
+	}
+	return entry.descriptor
+}
+
+// insertDirectoryEntry only changes the OFT buffer, the caller saves the directory
 func insertDirectoryEntry(filename string, descriptorIndx int) bool {
 	if searchDirectoryForFile(filename) != -1 {
 		return false
 	}
 
+	// reuse the slot of a destroyed file before growing the directory
+	used := make(map[int]bool)
+	for _, entry := range dirNameIndex {
+		used[entry.pos] = true
+	}
 	dirSize := oftFileSize[0]
-	if dirSize+8 > 512 {
+	pos := dirSize
+	for p := 0; p < dirSize; p += 8 {
+		if !used[p] {
+			pos = p
+			break
+		}
+	}
+	if pos+8 > maxDirectorySize {
+		return false
+	}
+
+	// the block has to exist before the entry goes in, or a full disk would lose it
+	offset, ok := directoryOffset(pos)
+	if !ok || writableBlock(0, pos/512) < 0 {
 		return false
 	}
 
-	pos := dirSize
 	for i := 0; i < 4; i++ {
 		if i < len(filename) {
-			oftBuffer[0][pos+i] = int(filename[i])
+			oftBuffer[0][offset+i] = int(filename[i])
 		} else {
-			oftBuffer[0][pos+i] = 0
+			oftBuffer[0][offset+i] = 0
 		}
 	}
 
-	convertIntegerToBytes(descriptorIndx, oftBuffer[0][:], pos+4)
-	oftFileSize[0] += 8
+	convertIntegerToBytes(descriptorIndx, oftBuffer[0][:], offset+4)
+	if pos == dirSize {
+		oftFileSize[0] += 8
+	}
+	dirNameIndex[filename] = directoryEntry{descriptorIndx, pos}
+	dirEntryIndex[descriptorIndx] = pos
 	return true
 }
 
+// deleteDirectoryEntry only changes the OFT buffer, the caller saves the directory
 func deleteDirectoryEntry(filename string) int {
-	dirSize := oftFileSize[0]
-	for pos := 0; pos < dirSize; pos += 8 {
-		name := getFileNameAtPosition(pos)
-		if name == filename {
-			index := convertBytesToInteger(oftBuffer[0][pos+4], oftBuffer[0][pos+5], oftBuffer[0][pos+6], oftBuffer[0][pos+7])
-			for i := 0; i < 8; i++ {
-				oftBuffer[0][pos+i] = 0
-			}
-			return index
-		}
+	entry, exists := dirNameIndex[filename]
+	if !exists {
+		return -1
 	}
-	return -1
+	offset, ok := directoryOffset(entry.pos)
+	if !ok {
+		return -1
+	}
+	for i := 0; i < 8; i++ {
+		oftBuffer[0][offset+i] = 0
+	}
+	delete(dirNameIndex, filename)
+	if dirEntryIndex[entry.descriptor] == entry.pos {
+		delete(dirEntryIndex, entry.descriptor)
+	}
+	return entry.descriptor
 }
 
-func buildDirectoryListing() string {
-	dirSize := oftFileSize[0]
+// directoryNames returns the file names in directory order from the index
+func directoryNames() []string {
+	names := make([]string, 0, len(dirNameIndex))
+	for name := range dirNameIndex {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return dirNameIndex[names[i]].pos < dirNameIndex[names[j]].pos
+	})
+	return names
+}
+
+// buildDirectoryListing lists the entries in directory order from the index, errChecksum
+// if the directory failed to load and errFS if an entry refers to a descriptor outside
+// the table
+func buildDirectoryListing() (string, error) {
+	if !oftValid[0] {
+		return "", errChecksum
+	}
 	result := ""
-	first := true
-	for pos := 0; pos < dirSize; pos += 8 {
-		name := getFileNameAtPosition(pos)
-		if name == "" {
-			continue
+	for i, name := range directoryNames() {
+		desc, ok := readDescriptor(dirNameIndex[name].descriptor)
+		if !ok {
+			return "", errFS
 		}
-		index := convertBytesToInteger(oftBuffer[0][pos+4], oftBuffer[0][pos+5], oftBuffer[0][pos+6], oftBuffer[0][pos+7])
-		desc := readDescriptor(index)
 		length := desc[0]
-		if !first {
+		if i > 0 {
 			result = result + " "
 		}
 		result = result + name + " " + strconv.Itoa(length)
-		first = false
 	}
-	return result
+	return result, nil
 }
 
 func descriptorInDirectory(descriptorIndx int) bool {
-	dirSize := oftFileSize[0]
-	for pos := 0; pos < dirSize; pos += 8 {
-		indexVal := convertBytesToInteger(oftBuffer[0][pos+4], oftBuffer[0][pos+5], oftBuffer[0][pos+6], oftBuffer[0][pos+7])
-		if indexVal == descriptorIndx {
-			return true
-		}
-	}
-	return false
+	_, exists := dirEntryIndex[descriptorIndx]
+	return exists
 }
 
 func findAvailableOFTSlot() int {
@@ -137,148 +257,291 @@ func findAvailableOFTSlot() int {
 	return -1
 }
 
+// physicalBlock maps block blockIndex of a file to its disk block, 0 for a hole
+func physicalBlock(desc [4]int, blockIndex int) int {
+	if allocationMode == "extent" {
+		if desc[1] == 0 || blockIndex < desc[3] || blockIndex >= desc[3]+desc[2] {
+			return 0
+		}
+		return desc[1] + blockIndex - desc[3]
+	}
+	return desc[1+blockIndex]
+}
+
+// descriptorBlocks lists the disk blocks a descriptor holds, in file order
+func descriptorBlocks(desc [4]int) []int {
+	var blocks []int
+	for i := 0; i < 3; i++ {
+		if blockNum := physicalBlock(desc, i); blockNum != 0 {
+			blocks = append(blocks, blockNum)
+		}
+	}
+	return blocks
+}
+
+// findFreeBlock must be called with allocMu held
 func findFreeBlock() int {
+	usedBlocks := blocksInUse()
+	for blockNum := firstDataBlock; blockNum < 64; blockNum++ {
+		if !usedBlocks[blockNum] {
+			return blockNum
+		}
+	}
+	return -1
+}
+
+// blocksInUse marks the reserved blocks and every block a descriptor or snapshot
+// holds, it must be called with allocMu held
+func blocksInUse() map[int]bool {
 	usedBlocks := make(map[int]bool)
-	for i := 0; i < 8; i++ {
+	for i := 0; i < firstDataBlock; i++ {
+		usedBlocks[i] = true
+	}
+	for i := diskBlocks; i < 64; i++ {
 		usedBlocks[i] = true
 	}
 
 	for i := 0; i < 192; i++ {
-		for j := 1; j < 4; j++ {
-			blockID := descriptors[i][j]
-			if blockID != 0 {
-				usedBlocks[blockID] = true
-			}
+		for _, blockID := range descriptorBlocks(descriptors[i]) {
+			usedBlocks[blockID] = true
 		}
 	}
 
-	for blockNum := 8; blockNum < 64; blockNum++ {
-		if !usedBlocks[blockNum] {
-			return blockNum
+	// blocks only a snapshot still refers to are not free either
+	for blockNum := firstDataBlock; blockNum < 64; blockNum++ {
+		if blockRefCount[blockNum] > 0 {
+			usedBlocks[blockNum] = true
 		}
 	}
-	return -1
+	return usedBlocks
+}
+
+// allocateBlock finds a free block and records it as block blockIndex of a file in one
+// step, so two writers can never be handed the same block
+func allocateBlock(descriptorIndx int, blockIndex int) int {
+	allocMu.Lock()
+	defer allocMu.Unlock()
+	if allocationMode == "extent" {
+		return allocateExtentBlock(descriptorIndx, blockIndex)
+	}
+	blockNum := findFreeBlock()
+	if blockNum >= 0 {
+		descriptors[descriptorIndx][1+blockIndex] = blockNum
+	}
+	return blockNum
 }
 
 func releaseBlock(blockNum int) {
 }
 
-func loadFileBlockIntoBuffer(oftIndex int, blockIndex int) {
+func blockShared(blockNum int) bool {
+	allocMu.Lock()
+	defer allocMu.Unlock()
+	return blockRefCount[blockNum] > 0
+}
+
+// writableBlock returns the block to write block blockIndex of a file into. A missing
+// block, or one a snapshot still refers to, is replaced by a newly allocated one so
+// the snapshot keeps the old contents. It returns -1 when the disk is full.
+func writableBlock(descriptorIndx int, blockIndex int) int {
+	desc, _ := readDescriptor(descriptorIndx)
+	blockNum := physicalBlock(desc, blockIndex)
+	if blockNum == 0 || blockShared(blockNum) {
+		blockNum = allocateBlock(descriptorIndx, blockIndex)
+	}
+	return blockNum
+}
+
+// loadFileBlockIntoBuffer switches the block held in an OFT buffer, false if the new
+// block fails its checksum, in which case the old block stays loaded
+func loadFileBlockIntoBuffer(oftIndex int, blockIndex int) bool {
 	descIndex := oftDescriptorIndex[oftIndex]
-	desc := readDescriptor(descIndex)
-	fileSize := oftFileSize[oftIndex]
+	desc, _ := readDescriptor(descIndex)
 	oldBlockIndex := oftLoadedBlock[oftIndex]
-	oldBlockNum := desc[1+oldBlockIndex]
+	oldBlockNum := physicalBlock(desc, oldBlockIndex)
 
-	if fileSize > 0 {
-		if oldBlockNum == 0 {
-			newb := findFreeBlock()
-			if newb < 0 {
-				return
-			}
-			desc[1+oldBlockIndex] = newb
-			oldBlockNum = newb
-		}
+	// an unallocated block is a hole, write allocates before touching the buffer,
+	// and a shared block was already copied by write if the buffer changed
+	if oldBlockNum != 0 && !blockShared(oldBlockNum) {
 		writeBlock(oldBlockNum, oftBuffer[oftIndex][:])
 	}
 
-	writeDescriptor(descIndex, desc)
-	oftLoadedBlock[oftIndex] = blockIndex
-	newBlockNum := desc[1+blockIndex]
+	newBlockNum := physicalBlock(desc, blockIndex)
 	if newBlockNum != 0 {
-		readBlock(newBlockNum, oftBuffer[oftIndex][:])
+		if !readBlock(newBlockNum, oftBuffer[oftIndex][:]) {
+			return false
+		}
 	} else {
 		for i := 0; i < 512; i++ {
 			oftBuffer[oftIndex][i] = 0
 		}
 	}
+	oftLoadedBlock[oftIndex] = blockIndex
+	return true
 }
 
+// saveDirectoryToDisk writes back the directory block held in the OFT buffer
 func saveDirectoryToDisk() {
-	d0 := readDescriptor(0)
-	block1 := d0[1]
-	writeBlock(block1, oftBuffer[0][:])
+	blockNum := writableBlock(0, oftLoadedBlock[0])
+	if blockNum < 0 {
+		return
+	}
+	writeBlock(blockNum, oftBuffer[0][:])
+	d0, _ := readDescriptor(0)
 	d0[0] = oftFileSize[0]
 	writeDescriptor(0, d0)
 }
 
-func initializeDirectoryOFT() {
-	oftValid[0] = true
+// initializeDirectoryOFT loads the directory into OFT entry 0, false if one of its
+// blocks fails the checksum, the entry is then left closed
+func initializeDirectoryOFT() bool {
+	oftValid[0] = false
+	oftMode[0] = "rw"
 	oftDescriptorIndex[0] = 0
 	oftLoadedBlock[0] = 0
-	d0 := readDescriptor(0)
+	d0, _ := readDescriptor(0)
 	oftFileSize[0] = d0[0]
 	oftCurrentPosition[0] = 0
-	block1 := d0[1]
+	block1 := physicalBlock(d0, 0)
 	if block1 != 0 {
-		readBlock(block1, oftBuffer[0][:])
+		if !readBlock(block1, oftBuffer[0][:]) {
+			dirNameIndex = make(map[string]directoryEntry)
+			dirEntryIndex = make(map[int]int)
+			return false
+		}
 	} else {
 		for i := 0; i < 512; i++ {
 			oftBuffer[0][i] = 0
 		}
 	}
+	if !rebuildDirectoryIndex() {
+		return false
+	}
+	oftValid[0] = true
+	return true
 }
 
 func finalizeDirectoryOFT() {
 	if oftValid[0] {
-		d0 := readDescriptor(0)
-		block1 := d0[1]
-		writeBlock(block1, oftBuffer[0][:])
-		d0[0] = oftFileSize[0]
-		writeDescriptor(0, d0)
+		saveDirectoryToDisk()
 		oftValid[0] = false
 	}
 }
 
 // DISK ACCESS FUNCTIONS
 
-func read_block(blockNum int, buffer []int) {
-	if blockNum >= 0 && blockNum < 64 {
-		for i := 0; i < 512; i++ {
-			buffer[i] = disk[blockNum][i]
+// blockChecksum computes the CRC32 of a block as stored on disk
+func blockChecksum(buffer []int) int {
+	var data [512]byte
+	for i := 0; i < 512; i++ {
+		data[i] = byte(buffer[i])
+	}
+	return int(crc32.ChecksumIEEE(data[:]))
+}
+
+// read_block copies a block into buffer, false without touching buffer if the block
+// does not match the checksum kept for it in block 0
+func read_block(blockNum int, buffer []int) bool {
+	if blockNum < 0 || blockNum >= 64 {
+		return true
+	}
+	blockReads.Add(1)
+	if blockNum != 0 {
+		pos := 256 + 4*blockNum
+		stored := convertBytesToInteger(disk[0][pos], disk[0][pos+1], disk[0][pos+2], disk[0][pos+3])
+		if blockChecksum(disk[blockNum][:]) != stored {
+			return false
 		}
 	}
+	for i := 0; i < 512; i++ {
+		buffer[i] = disk[blockNum][i]
+	}
+	return true
 }
 
+// write_block stores a block and records its checksum in the second half of block 0
 func write_block(blockNum int, buffer []int) {
 	if blockNum >= 0 && blockNum < 64 {
+		blockWrites.Add(1)
 		for i := 0; i < 512; i++ {
 			disk[blockNum][i] = buffer[i]
 		}
+		if blockNum != 0 {
+			convertIntegerToBytes(blockChecksum(buffer), disk[0][:], 256+4*blockNum)
+		}
 	}
 }
 
-func readBlock(blockNum int, buffer []int) {
-	read_block(blockNum, buffer)
+// readBlock and writeBlock go through the blocks held by a transaction
+func readBlock(blockNum int, buffer []int) bool {
+	if block, buffered := bufferedBlock(blockNum); buffered {
+		copy(buffer, block[:])
+		return true
+	}
+	return read_block(blockNum, buffer)
 }
 
 func writeBlock(blockNum int, buffer []int) {
-	write_block(blockNum, buffer)
+	if !bufferBlock(blockNum, buffer) {
+		write_block(blockNum, buffer)
+	}
 }
 
-func readDescriptor(i int) [4]int {
+// readDescriptor returns false for an index outside the table, such as -1 for a
+// missing file or the index of a damaged directory entry
+func readDescriptor(i int) ([4]int, bool) {
+	allocMu.Lock()
+	defer allocMu.Unlock()
 	var desc [4]int
+	if i < 0 || i >= 192 {
+		return desc, false
+	}
 	for j := 0; j < 4; j++ {
 		desc[j] = descriptors[i][j]
 	}
-	return desc
+	return desc, true
 }
 
-func writeDescriptor(i int, desc [4]int) {
+// writeDescriptor returns false and changes nothing for an index outside the table
+func writeDescriptor(i int, desc [4]int) bool {
+	allocMu.Lock()
+	defer allocMu.Unlock()
+	if i < 0 || i >= 192 {
+		return false
+	}
 	for j := 0; j < 4; j++ {
 		descriptors[i][j] = desc[j]
 	}
+	return true
 }
 
 // MAIN FILE SYSTEM FUNCTIONS
 
-// init_fs initializes
+// init_fs initializes, formatting for the layout in allocationMode
 func init_fs() {
-	// clear disk
+	resetTransaction()
+	resetVolumes()
+	resetSession()
+	formatDisk()
+	resetIOCounts()
+}
+
+// resetSession closes every file, leaves only process 0 and clears memory
+func resetSession() {
+	resetOpenFiles()
+
+	// clear memory
+	for i := 0; i < 512; i++ {
+		memory[i] = 0
+	}
+}
+
+// formatDisk lays out an empty file system on the active volume
+func formatDisk() {
+	// clear disk, writing the empty blocks gives each one a valid checksum
+	var emptyBlock [512]int
 	for i := 0; i < 64; i++ {
-		for j := 0; j < 512; j++ {
-			disk[i][j] = 0
-		}
+		writeBlock(i, emptyBlock[:])
 	}
 
 	// clear descriptors
@@ -288,10 +551,20 @@ func init_fs() {
 		}
 	}
 	descriptors[0][0] = 0
-	descriptors[0][1] = 7
+	descriptors[0][1] = rootDirectoryBlock
 	descriptors[0][2] = 0
 	descriptors[0][3] = 0
+	if allocationMode == "extent" {
+		descriptors[0][2] = 1
+	}
+
+	// every block was just written with its checksum, the directory always loads
+	resetSnapshots()
+	initializeDirectoryOFT()
+	writeSuperblock()
+}
 
+func resetOpenFiles() {
 	for i := 0; i < 4; i++ {
 		for j := 0; j < 512; j++ {
 			oftBuffer[i][j] = 0
@@ -301,43 +574,76 @@ func init_fs() {
 		oftDescriptorIndex[i] = -1
 		oftValid[i] = false
 		oftLoadedBlock[i] = 0
+		oftMode[i] = ""
+		oftRefCount[i] = 0
+		oftVolume[i] = ""
 	}
 
-	// clear memory
-	for i := 0; i < 512; i++ {
-		memory[i] = 0
+	// only process 0 survives a reset
+	for p := 0; p < 8; p++ {
+		procValid[p] = false
+		for fd := 0; fd < 8; fd++ {
+			procFD[p][fd] = 0
+		}
 	}
-	initializeDirectoryOFT()
-	output = append(output, "system initialized")
+	procValid[0] = true
+	currentProc = 0
+	resetLocks()
+	resetSnapshots()
 }
 
 // creates a new file with the given name
 func create(name string) {
-	if len(name) > 3 {
-		output = append(output, "error")
+	err := currentFS.Create(name)
+	if err == errChecksum {
+		output = append(output, "checksum error")
 		return
 	}
-
-	if searchDirectoryForFile(name) != -1 {
+	if err != nil {
 		output = append(output, "error")
 		return
 	}
+	output = append(output, name+" created")
+}
 
-	// find free descriptor
-	descriptorIndx := -1
+// createFile adds an empty file to the directory and returns its descriptor index, -1
+// or checksumError when the directory failed to load
+func createFile(name string) int {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	return createFileLocked(name)
+}
+
+// findFreeDescriptor returns an empty descriptor that no directory entry refers to, or
+// -1, the caller holds dirMu
+func findFreeDescriptor() int {
 	for i := 1; i < 192; i++ {
-		d := readDescriptor(i)
+		d, _ := readDescriptor(i)
 		if d[0] == 0 && d[1] == 0 && d[2] == 0 && d[3] == 0 {
 			if !descriptorInDirectory(i) {
-				descriptorIndx = i
-				break
+				return i
 			}
 		}
 	}
+	return -1
+}
+
+// createFileLocked is createFile for callers already holding dirMu
+func createFileLocked(name string) int {
+	if !oftValid[0] {
+		return checksumError
+	}
+	if len(name) > 3 || mountedSnapshot != "" {
+		return -1
+	}
+
+	if searchDirectoryForFile(name) != -1 {
+		return -1
+	}
 
+	descriptorIndx := findFreeDescriptor()
 	if descriptorIndx == -1 {
-		output = append(output, "error")
-		return
+		return -1
 	}
 
 	var emptyDesc [4]int
@@ -348,35 +654,60 @@ func create(name string) {
 	writeDescriptor(descriptorIndx, emptyDesc)
 
 	if !insertDirectoryEntry(name, descriptorIndx) {
-		output = append(output, "error")
-		return
+		return -1
 	}
 	saveDirectoryToDisk()
-	output = append(output, name+" created")
+	return descriptorIndx
 }
 
 func destroy(name string) {
+	err := currentFS.Destroy(name)
+	if err == errChecksum {
+		output = append(output, "checksum error")
+		return
+	}
+	if err != nil {
+		output = append(output, "error")
+		return
+	}
+	output = append(output, name+" destroyed")
+}
+
+// destroyFile removes a file that is not open and returns its old descriptor index, -1
+// or checksumError when the directory failed to load
+func destroyFile(name string) int {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	return destroyFileLocked(name)
+}
+
+// destroyFileLocked is destroyFile for callers already holding dirMu
+func destroyFileLocked(name string) int {
+	if !oftValid[0] {
+		return checksumError
+	}
+	if mountedSnapshot != "" {
+		return -1
+	}
+
 	descriptorIndxCheck := searchDirectoryForFile(name)
-	if descriptorIndxCheck != -1 {
-		for i := 1; i < 4; i++ {
-			if oftValid[i] && oftDescriptorIndex[i] == descriptorIndxCheck {
-				output = append(output, "error")
-				return
-			}
+	desc, ok := readDescriptor(descriptorIndxCheck)
+	if !ok {
+		return -1
+	}
+	for i := 1; i < 4; i++ {
+		if oftValid[i] && oftVolume[i] == activeVolume && oftDescriptorIndex[i] == descriptorIndxCheck {
+			return -1
 		}
 	}
 
 	descriptorIndx := deleteDirectoryEntry(name)
 	if descriptorIndx == -1 {
-		output = append(output, "error")
-		return
+		return -1
 	}
 
-	desc := readDescriptor(descriptorIndx)
-	for j := 1; j < 4; j++ {
-		if desc[j] != 0 {
-			releaseBlock(desc[j])
-		}
+	for _, blockNum := range descriptorBlocks(desc) {
+		releaseBlock(blockNum)
 	}
 
 	var emptyDesc [4]int
@@ -386,74 +717,170 @@ func destroy(name string) {
 	emptyDesc[3] = 0
 	writeDescriptor(descriptorIndx, emptyDesc)
 	saveDirectoryToDisk()
-	output = append(output, name+" destroyed")
+	return descriptorIndx
 }
 
-// opens a file by name
-func open(name string) {
-	descriptorIndx := searchDirectoryForFile(name)
-	if descriptorIndx == -1 {
+// opens a file by name, mode is one of r, w, rw or a, create makes a missing file
+// and exclusive fails if the file already exists
+func open(name string, mode string, create bool, exclusive bool) {
+	fd := findAvailableFD()
+	if fd == -1 {
+		output = append(output, "error")
+		return
+	}
+	slot, err := currentFS.Open(name, mode, create, exclusive)
+	if err == errChecksum {
+		output = append(output, "checksum error")
+		return
+	}
+	if err != nil {
 		output = append(output, "error")
 		return
 	}
+	procFD[currentProc][fd] = slot
+	output = append(output, name+" opened "+strconv.Itoa(fd))
+}
+
+// openFile claims an OFT entry for a file and returns its index, -1 or checksumError
+func openFile(name string, mode string, create bool, exclusive bool) int {
+	if mode != "r" && mode != "w" && mode != "rw" && mode != "a" {
+		return -1
+	}
+
+	dirMu.Lock()
+	defer dirMu.Unlock()
+
+	if !oftValid[0] {
+		return checksumError
+	}
+	if mode != "r" && mountedSnapshot != "" {
+		return -1
+	}
+
+	descriptorIndx := searchDirectoryForFile(name)
+	if descriptorIndx != -1 && exclusive {
+		return -1
+	}
+	if _, ok := readDescriptor(descriptorIndx); descriptorIndx != -1 && !ok {
+		return -1
+	}
 
-	// check if open
+	// check if open, only readers may share a file
 	for i := 0; i < 4; i++ {
-		if oftValid[i] && oftDescriptorIndex[i] == descriptorIndx {
-			output = append(output, "error")
-			return
+		if oftValid[i] && oftVolume[i] == activeVolume && oftDescriptorIndex[i] == descriptorIndx {
+			if mode != "r" || oftMode[i] != "r" {
+				return -1
+			}
 		}
 	}
 
 	slot := findAvailableOFTSlot()
 	if slot == -1 {
-		output = append(output, "error")
-		return
+		return -1
 	}
 
-	desc := readDescriptor(descriptorIndx)
-	oftValid[slot] = true
-	oftDescriptorIndex[slot] = descriptorIndx
-	oftFileSize[slot] = desc[0]
-	oftCurrentPosition[slot] = 0
-	oftLoadedBlock[slot] = 0
-	block0 := desc[1]
+	if descriptorIndx == -1 {
+		if !create && !exclusive {
+			return -1
+		}
+		descriptorIndx = createFileLocked(name)
+		if descriptorIndx < 0 {
+			return descriptorIndx
+		}
+	}
+
+	oftMu[slot].Lock()
+	defer oftMu[slot].Unlock()
+
+	desc, _ := readDescriptor(descriptorIndx)
+	block0 := physicalBlock(desc, 0)
 	if block0 != 0 {
-		readBlock(block0, oftBuffer[slot][:])
+		if !readBlock(block0, oftBuffer[slot][:]) {
+			return checksumError
+		}
 	} else {
 		for i := 0; i < 512; i++ {
 			oftBuffer[slot][i] = 0
 		}
 	}
 
-	output = append(output, name+" opened "+strconv.Itoa(slot))
+	oftValid[slot] = true
+	oftVolume[slot] = activeVolume
+	oftMode[slot] = mode
+	oftRefCount[slot] = 1
+	oftDescriptorIndex[slot] = descriptorIndx
+	oftFileSize[slot] = desc[0]
+	oftCurrentPosition[slot] = 0
+	oftLoadedBlock[slot] = 0
+	return slot
 }
 
-func close_file(index int) {
-	if index < 0 || index >= 4 || !oftValid[index] {
+// close_file drops a descriptor, the OFT entry is only closed once nothing refers to it
+func close_file(fd int) {
+	if fdToOFT(fd) == -1 {
 		output = append(output, "error")
 		return
 	}
+	releaseFD(currentProc, fd)
+	output = append(output, strconv.Itoa(fd)+" closed")
+	reportLockGrants()
+}
+
+// retainOFTEntry adds a reference to an open OFT entry
+func retainOFTEntry(index int) bool {
+	if index < 1 || index >= 4 {
+		return false
+	}
+	oftMu[index].Lock()
+	defer oftMu[index].Unlock()
+	if !oftValid[index] {
+		return false
+	}
+	oftRefCount[index]++
+	return true
+}
+
+// releaseOFTEntry drops a reference to an OFT entry and closes it with the last one,
+// the locks are held from the count to the close so a Dup cannot come in between
+func releaseOFTEntry(index int) bool {
+	if index < 1 || index >= 4 {
+		return false
+	}
+
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	oftMu[index].Lock()
+	defer oftMu[index].Unlock()
+
+	if !oftValid[index] {
+		return false
+	}
+	oftRefCount[index]--
+	if oftRefCount[index] > 0 {
+		return true
+	}
+	closeOFTEntry(index)
+	return true
+}
 
+// closeOFTEntry writes back an OFT entry and frees it, the caller holds dirMu and the
+// entry's lock
+func closeOFTEntry(index int) {
 	descIndex := oftDescriptorIndex[index]
-	desc := readDescriptor(descIndex)
+	desc, _ := readDescriptor(descIndex)
 	fileSize := oftFileSize[index]
-	if fileSize > 0 {
-		blockNum := desc[1+oftLoadedBlock[index]]
-		if blockNum == 0 {
-			blockNum = findFreeBlock()
-			if blockNum < 0 {
-				output = append(output, "error")
-				return
-			}
-			desc[1+oftLoadedBlock[index]] = blockNum
-		}
+	blockNum := physicalBlock(desc, oftLoadedBlock[index])
+	if blockNum != 0 && !blockShared(blockNum) {
 		writeBlock(blockNum, oftBuffer[index][:])
 	}
 
 	desc[0] = fileSize
 	writeDescriptor(descIndex, desc)
+	releaseOFTLock(index)
 	oftValid[index] = false
+	oftVolume[index] = ""
+	oftMode[index] = ""
+	oftRefCount[index] = 0
 	oftDescriptorIndex[index] = -1
 	oftFileSize[index] = 0
 	oftCurrentPosition[index] = 0
@@ -461,34 +888,61 @@ func close_file(index int) {
 	for i := 0; i < 512; i++ {
 		oftBuffer[index][i] = 0
 	}
-
-	output = append(output, strconv.Itoa(index)+" closed")
 }
 
-func read(oftIndex int, memoryOffset int, count int) {
-	if oftIndex < 0 || oftIndex >= 4 || !oftValid[oftIndex] {
+func read(fd int, memoryOffset int, count int) {
+	oftIndex := fdToOFT(fd)
+	if oftIndex == -1 {
 		output = append(output, "error")
 		return
 	}
-	if memoryOffset < 0 || memoryOffset+count > 512 || count < 0 {
+	if !validMemoryRange(memoryOffset, count) {
 		output = append(output, "error")
 		return
 	}
-	fileSize := oftFileSize[oftIndex]
-	curPos := oftCurrentPosition[oftIndex]
-	if curPos >= fileSize {
-		output = append(output, "0 bytes read from "+strconv.Itoa(oftIndex))
+	data := make([]byte, count)
+	totalRead, err := currentFS.Read(oftIndex, data)
+	if err == errChecksum {
+		output = append(output, "checksum error")
+		return
+	}
+	if err != nil {
+		output = append(output, "error")
 		return
 	}
+	for i := 0; i < totalRead; i++ {
+		memory[memoryOffset+i] = int(data[i])
+	}
+	output = append(output, strconv.Itoa(totalRead)+" bytes read from "+strconv.Itoa(fd))
+}
+
+// readFromOFT fills buffer from the current position of an OFT entry and returns
+// the number of bytes read, -1 or checksumError
+func readFromOFT(oftIndex int, buffer []int) int {
+	if oftIndex < 1 || oftIndex >= 4 {
+		return -1
+	}
+
+	oftMu[oftIndex].Lock()
+	defer oftMu[oftIndex].Unlock()
+
+	if !oftValid[oftIndex] || oftMode[oftIndex] == "w" || oftMode[oftIndex] == "a" {
+		return -1
+	}
+
+	fileSize := oftFileSize[oftIndex]
+	curPos := oftCurrentPosition[oftIndex]
 	totalRead := 0
-	remaining := count
+	remaining := len(buffer)
+	corrupt := false
 
 	for remaining > 0 && curPos < fileSize && curPos < 3*512 {
 		blockIndex := curPos / 512
 		offsetInBlock := curPos % 512
 
-		if blockIndex != oftLoadedBlock[oftIndex] {
-			loadFileBlockIntoBuffer(oftIndex, blockIndex)
+		if blockIndex != oftLoadedBlock[oftIndex] && !loadFileBlockIntoBuffer(oftIndex, blockIndex) {
+			corrupt = true
+			break
 		}
 		spaceInBlock := 512 - offsetInBlock
 		canRead := remaining
@@ -500,7 +954,7 @@ func read(oftIndex int, memoryOffset int, count int) {
 		}
 
 		for i := 0; i < canRead; i++ {
-			memory[memoryOffset+totalRead+i] = oftBuffer[oftIndex][offsetInBlock+i]
+			buffer[totalRead+i] = oftBuffer[oftIndex][offsetInBlock+i]
 		}
 		curPos += canRead
 		totalRead += canRead
@@ -508,32 +962,85 @@ func read(oftIndex int, memoryOffset int, count int) {
 	}
 
 	oftCurrentPosition[oftIndex] = curPos
-	output = append(output, strconv.Itoa(totalRead)+" bytes read from "+strconv.Itoa(oftIndex))
+	if corrupt {
+		return checksumError
+	}
+	return totalRead
 }
 
-func write(oftIndex int, memoryOffset int, count int) {
-	if oftIndex < 0 || oftIndex >= 4 || !oftValid[oftIndex] {
+func write(fd int, memoryOffset int, count int) {
+	oftIndex := fdToOFT(fd)
+	if oftIndex == -1 {
 		output = append(output, "error")
 		return
 	}
-	if memoryOffset < 0 || memoryOffset+count > 512 || count < 0 {
+	if !validMemoryRange(memoryOffset, count) {
 		output = append(output, "error")
 		return
 	}
-
-	fileSize := oftFileSize[oftIndex]
+	data := make([]byte, count)
+	for i := 0; i < count; i++ {
+		data[i] = byte(memory[memoryOffset+i])
+	}
+	totalWritten, err := currentFS.Write(oftIndex, data)
+	if err == errChecksum {
+		output = append(output, "checksum error")
+		return
+	}
+	if err != nil && err != errDiskFull {
+		output = append(output, "error")
+		return
+	}
+	if err == errDiskFull {
+		output = append(output, strconv.Itoa(totalWritten)+" bytes written to "+strconv.Itoa(fd)+", disk full")
+		return
+	}
+	output = append(output, strconv.Itoa(totalWritten)+" bytes written to "+strconv.Itoa(fd))
+}
+
+// writeToOFT stores data at the current position of an OFT entry and returns
+// the number of bytes written, -1 or checksumError. full is set when the write
+// stopped early because no free block was left.
+func writeToOFT(oftIndex int, data []int) (int, bool) {
+	if oftIndex < 1 || oftIndex >= 4 {
+		return -1, false
+	}
+
+	oftMu[oftIndex].Lock()
+	defer oftMu[oftIndex].Unlock()
+
+	if !oftValid[oftIndex] || oftMode[oftIndex] == "r" {
+		return -1, false
+	}
+
+	// append handles always write at the end of the file
+	if oftMode[oftIndex] == "a" {
+		oftCurrentPosition[oftIndex] = oftFileSize[oftIndex]
+	}
+
+	fileSize := oftFileSize[oftIndex]
 	curPos := oftCurrentPosition[oftIndex]
 	descIndex := oftDescriptorIndex[oftIndex]
 
 	totalWritten := 0
-	remaining := count
+	remaining := len(data)
+	corrupt := false
+	full := false
 
 	for remaining > 0 && curPos < 3*512 {
 		blockIndex := curPos / 512
 		offsetInBlock := curPos % 512
 
-		if blockIndex != oftLoadedBlock[oftIndex] {
-			loadFileBlockIntoBuffer(oftIndex, blockIndex)
+		if blockIndex != oftLoadedBlock[oftIndex] && !loadFileBlockIntoBuffer(oftIndex, blockIndex) {
+			corrupt = true
+			break
+		}
+
+		// only the block being written gets allocated, holes before it stay unallocated
+		realBlock := writableBlock(descIndex, blockIndex)
+		if realBlock < 0 {
+			full = true
+			break
 		}
 
 		spaceInBlock := 512 - offsetInBlock
@@ -543,24 +1050,13 @@ func write(oftIndex int, memoryOffset int, count int) {
 		}
 
 		for i := 0; i < toWrite; i++ {
-			oftBuffer[oftIndex][offsetInBlock+i] = memory[memoryOffset+totalWritten+i]
+			oftBuffer[oftIndex][offsetInBlock+i] = data[totalWritten+i]
 		}
 		curPos += toWrite
 		remaining -= toWrite
 		totalWritten += toWrite
 
-		d := readDescriptor(descIndex)
-		realBlock := d[1+blockIndex]
-
-		if realBlock == 0 {
-			realBlock = findFreeBlock()
-			if realBlock < 0 {
-				break
-			}
-			d[1+blockIndex] = realBlock
-		}
 		writeBlock(realBlock, oftBuffer[oftIndex][:])
-		writeDescriptor(descIndex, d)
 
 		if curPos > fileSize {
 			fileSize = curPos
@@ -570,54 +1066,311 @@ func write(oftIndex int, memoryOffset int, count int) {
 	oftFileSize[oftIndex] = fileSize
 	oftCurrentPosition[oftIndex] = curPos
 
-	desc := readDescriptor(descIndex)
+	desc, _ := readDescriptor(descIndex)
 
 	desc[0] = fileSize
 
 	writeDescriptor(descIndex, desc)
+	if corrupt {
+		return checksumError, false
+	}
+	return totalWritten, full
+}
+
+func seek(fd int, pos int) {
+	index := fdToOFT(fd)
+	if index == -1 {
+		output = append(output, "error")
+		return
+	}
+	err := currentFS.Seek(index, pos)
+	if err == errChecksum {
+		output = append(output, "checksum error")
+		return
+	}
+	if err != nil {
+		output = append(output, "error")
+		return
+	}
+	output = append(output, "position is "+strconv.Itoa(pos))
+}
+
+// seekOFT moves the position of an OFT entry and returns it, -1 if the entry is not
+// open or pos is out of range, or checksumError
+func seekOFT(index int, pos int) int {
+	if index < 1 || index >= 4 {
+		return -1
+	}
+
+	oftMu[index].Lock()
+	defer oftMu[index].Unlock()
 
-	output = append(output, strconv.Itoa(totalWritten)+" bytes written to "+strconv.Itoa(oftIndex))
+	if !oftValid[index] {
+		return -1
+	}
+
+	// seeking past the end is allowed, a later write leaves a hole
+	if pos < 0 || pos > 3*512 {
+		return -1
+	}
+
+	newBlockIndex := pos / 512
+	if newBlockIndex < 3 && newBlockIndex != oftLoadedBlock[index] {
+		if !loadFileBlockIntoBuffer(index, newBlockIndex) {
+			return checksumError
+		}
+	}
+
+	oftCurrentPosition[index] = pos
+	return pos
 }
 
-func seek(index int, pos int) {
-	if index < 0 || index >= 4 || !oftValid[index] {
+func directory() {
+	listing, err := currentFS.Directory()
+	if err == errChecksum {
+		output = append(output, "checksum error")
+		return
+	}
+	if err != nil {
 		output = append(output, "error")
 		return
 	}
-	if pos < 0 {
+	output = append(output, listing)
+}
+
+// stat prints the logical size of a file next to the number of blocks it really uses
+func stat(name string) {
+	dirMu.Lock()
+	desc, ok := readDescriptor(searchDirectoryForFile(name))
+	dirMu.Unlock()
+	if !ok {
 		output = append(output, "error")
 		return
 	}
+	blocks := len(descriptorBlocks(desc))
+	output = append(output, name+" size "+strconv.Itoa(desc[0])+" blocks "+strconv.Itoa(blocks))
+}
 
-	fileSize := oftFileSize[index]
-	if pos > fileSize {
+// PROCESS FUNCTIONS
+
+// fdToOFT returns the OFT entry a descriptor of the running process refers to, or -1,
+// and makes the volume of its file the active one
+func fdToOFT(fd int) int {
+	if fd < 1 || fd >= 8 || procFD[currentProc][fd] == 0 {
+		return -1
+	}
+	useFileVolume(procFD[currentProc][fd])
+	return procFD[currentProc][fd]
+}
+
+// findAvailableFD returns the lowest free descriptor of the running process, or -1
+func findAvailableFD() int {
+	for fd := 1; fd < 8; fd++ {
+		if procFD[currentProc][fd] == 0 {
+			return fd
+		}
+	}
+	return -1
+}
+
+// releaseFD drops one reference to an OFT entry and closes it with the last one
+func releaseFD(pid int, fd int) {
+	index := procFD[pid][fd]
+	procFD[pid][fd] = 0
+	useFileVolume(index)
+	currentFS.Close(index)
+}
+
+func findAvailableProcess() int {
+	for p := 1; p < 8; p++ {
+		if !procValid[p] {
+			return p
+		}
+	}
+	return -1
+}
+
+// spawn starts a process with an empty descriptor table
+func spawn() {
+	pid := findAvailableProcess()
+	if pid == -1 {
 		output = append(output, "error")
 		return
 	}
-	if pos > 3*512 {
+	procValid[pid] = true
+	output = append(output, "process "+strconv.Itoa(pid)+" spawned")
+}
+
+// fork starts a child of the running process that inherits its descriptors,
+// parent and child share the OFT entries and so the file positions
+func fork() {
+	pid := findAvailableProcess()
+	if pid == -1 {
 		output = append(output, "error")
 		return
 	}
+	procValid[pid] = true
+	for fd := 1; fd < 8; fd++ {
+		index := procFD[currentProc][fd]
+		procFD[pid][fd] = index
+		if index != 0 {
+			currentFS.Dup(index)
+		}
+	}
+	output = append(output, "process "+strconv.Itoa(pid)+" forked")
+}
 
-	oldPos := oftCurrentPosition[index]
-	oldBlockIndex := oldPos / 512
-	newBlockIndex := pos / 512
+// switch_process makes pid the process later commands run as
+func switch_process(pid int) {
+	if pid < 0 || pid >= 8 || !procValid[pid] {
+		output = append(output, "error")
+		return
+	}
+	currentProc = pid
+	output = append(output, "process "+strconv.Itoa(pid)+" running")
+}
 
-	if newBlockIndex != oldBlockIndex {
-		loadFileBlockIntoBuffer(index, newBlockIndex)
+// exit_process closes every descriptor of the running process and returns to process 0
+func exit_process() {
+	if currentProc == 0 {
+		output = append(output, "error")
+		return
 	}
+	for fd := 1; fd < 8; fd++ {
+		if procFD[currentProc][fd] != 0 {
+			releaseFD(currentProc, fd)
+		}
+	}
+	procValid[currentProc] = false
+	output = append(output, "process "+strconv.Itoa(currentProc)+" exited")
+	currentProc = 0
+	reportLockGrants()
+}
 
-	oftCurrentPosition[index] = pos
-	output = append(output, "position is "+strconv.Itoa(pos))
+// corrupt_block flips the bits of one byte of a block behind the checksum's back,
+// so the next read of the block fails
+func corrupt_block(blockNum int, offset int) {
+	if blockNum < 1 || blockNum >= diskBlocks || offset < 0 || offset >= 512 {
+		output = append(output, "error")
+		return
+	}
+	disk[blockNum][offset] = disk[blockNum][offset] ^ 255
+	output = append(output, "block "+strconv.Itoa(blockNum)+" corrupted")
 }
 
-func directory() {
-	listing := buildDirectoryListing()
-	output = append(output, listing)
+// HOST FILE FUNCTIONS
+
+// readFileData returns the contents of a file straight from its disk blocks, false
+// if one of them fails its checksum
+func readFileData(descriptorIndx int) ([]int, bool) {
+	desc, ok := readDescriptor(descriptorIndx)
+	if !ok {
+		return nil, false
+	}
+	data := make([]int, desc[0])
+	var block [512]int
+	for pos := 0; pos < len(data); pos += 512 {
+		blockNum := physicalBlock(desc, pos/512)
+		if blockNum != 0 {
+			if !readBlock(blockNum, block[:]) {
+				return nil, false
+			}
+		} else {
+			block = [512]int{}
+		}
+		copy(data[pos:], block[:])
+	}
+	return data, true
+}
+
+// writeFileData stores data as the contents of an empty file, allocating its blocks
+func writeFileData(descriptorIndx int, data []int) bool {
+	if len(data) > 3*512 {
+		return false
+	}
+	for pos := 0; pos < len(data); pos += 512 {
+		blockNum := allocateBlock(descriptorIndx, pos/512)
+		if blockNum < 0 {
+			return false
+		}
+		var block [512]int
+		copy(block[:], data[pos:])
+		writeBlock(blockNum, block[:])
+	}
+	desc, ok := readDescriptor(descriptorIndx)
+	if !ok {
+		return false
+	}
+	desc[0] = len(data)
+	return writeDescriptor(descriptorIndx, desc)
+}
+
+// import_file copies a host file into a newly created file
+func import_file(hostPath string, name string) {
+	content, err := os.ReadFile(hostPath)
+	if err != nil || len(content) > 3*512 {
+		output = append(output, "error")
+		return
+	}
+
+	descriptorIndx := createFile(name)
+	if descriptorIndx == checksumError {
+		output = append(output, "checksum error")
+		return
+	}
+	if descriptorIndx == -1 {
+		output = append(output, "error")
+		return
+	}
+
+	data := make([]int, len(content))
+	for i := 0; i < len(content); i++ {
+		data[i] = int(content[i])
+	}
+	if !writeFileData(descriptorIndx, data) {
+		// undo the create so a full disk leaves no partial file behind
+		destroyFile(name)
+		output = append(output, "error")
+		return
+	}
+	output = append(output, strconv.Itoa(len(data))+" bytes imported to "+name)
+}
+
+// export_file copies the contents of a file out to a host file
+func export_file(name string, hostPath string) {
+	dirMu.Lock()
+	descriptorIndx := searchDirectoryForFile(name)
+	_, valid := readDescriptor(descriptorIndx)
+	dirMu.Unlock()
+	if !valid {
+		output = append(output, "error")
+		return
+	}
+
+	data, ok := readFileData(descriptorIndx)
+	if !ok {
+		output = append(output, "checksum error")
+		return
+	}
+	content := make([]byte, len(data))
+	for i := 0; i < len(data); i++ {
+		content[i] = byte(data[i])
+	}
+	if err := os.WriteFile(hostPath, content, 0644); err != nil {
+		output = append(output, "error")
+		return
+	}
+	output = append(output, strconv.Itoa(len(content))+" bytes exported from "+name)
 }
 
 // MEMORY FUNCTIONS
 
+// validMemoryRange checks that count bytes starting at memoryOffset lie in memory,
+// without adding the two, which could overflow for huge arguments
+func validMemoryRange(memoryOffset int, count int) bool {
+	return memoryOffset >= 0 && count >= 0 && count <= 512-memoryOffset
+}
+
 func write_memory(memoryOffset int, dataString string) {
 	if memoryOffset < 0 || memoryOffset >= 512 {
 		output = append(output, "error")
@@ -634,7 +1387,7 @@ func write_memory(memoryOffset int, dataString string) {
 }
 
 func read_memory(memoryOffset int, count int) {
-	if memoryOffset < 0 || memoryOffset+count > 512 || count < 0 {
+	if !validMemoryRange(memoryOffset, count) {
 		output = append(output, "error")
 		return
 	}
@@ -648,9 +1401,67 @@ func read_memory(memoryOffset int, count int) {
 	output = append(output, data)
 }
 
+// decodeMemoryData turns a hex or base64 argument into raw bytes
+func decodeMemoryData(encoding string, encoded string) ([]byte, error) {
+	if encoding == "hex" {
+		return hex.DecodeString(encoded)
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// encodeMemoryData turns raw bytes into a hex or base64 string
+func encodeMemoryData(encoding string, data []byte) string {
+	if encoding == "hex" {
+		return hex.EncodeToString(data)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// write_memory_encoded is write_memory for hex or base64 data, so any byte can be stored
+func write_memory_encoded(memoryOffset int, encoding string, encoded string) {
+	if memoryOffset < 0 || memoryOffset >= 512 {
+		output = append(output, "error")
+		return
+	}
+	data, err := decodeMemoryData(encoding, encoded)
+	if err != nil {
+		output = append(output, "error")
+		return
+	}
+	n := len(data)
+	if memoryOffset+n > 512 {
+		n = 512 - memoryOffset
+	}
+	for i := 0; i < n; i++ {
+		memory[memoryOffset+i] = int(data[i])
+	}
+	output = append(output, strconv.Itoa(n)+" bytes written to M")
+}
+
+// read_memory_encoded is read_memory printing every byte, zeros included, as hex or base64
+func read_memory_encoded(memoryOffset int, count int, encoding string) {
+	if !validMemoryRange(memoryOffset, count) {
+		output = append(output, "error")
+		return
+	}
+	data := make([]byte, count)
+	for i := 0; i < count; i++ {
+		data[i] = byte(memory[memoryOffset+i])
+	}
+	output = append(output, encodeMemoryData(encoding, data))
+}
+
 // MAIN FUNCTION
 
 func main() {
+	host := flag.String("host", "", "run the file commands on real files in a new directory under this one")
+	serve := flag.String("9p", "", "after input.txt, serve the file system over 9P on this TCP address or socket path")
+	serveHTTP := flag.String("http", "", "after input.txt, serve the file system as a JSON API on this address")
+	flag.Parse()
+	if *host != "" {
+		currentFS = &hostFS{root: *host}
+	}
+
 	inputFile, err := os.Open("input.txt")
 	if err != nil {
 		fmt.Println("Error opening input.txt:", err)
@@ -658,7 +1469,48 @@ func main() {
 	}
 	defer inputFile.Close()
 
-	scanner := bufio.NewScanner(inputFile)
+	outputFile, err := os.Create("output.txt")
+	if err != nil {
+		fmt.Println("Error creating output.txt:", err)
+		return
+	}
+	defer outputFile.Close()
+
+	if err := run(inputFile, outputFile); err != nil {
+		fmt.Println("Error writing output.txt:", err)
+	}
+
+	if *serve == "" && *serveHTTP == "" {
+		return
+	}
+	if *host != "" {
+		fmt.Println("Error: the servers export the simulated disk, not a host directory")
+		return
+	}
+	// the servers export the root volume, whichever one the last command left active
+	useVolume(rootVolume)
+	served := make(chan error)
+	if *serve != "" {
+		listener, err := listen9P(*serve)
+		if err != nil {
+			fmt.Println("Error listening for 9P:", err)
+			return
+		}
+		fmt.Println("Serving 9P on", listener.Addr())
+		go func() { served <- serve9P(listener) }()
+	}
+	if *serveHTTP != "" {
+		fmt.Println("Serving HTTP on", *serveHTTP)
+		go func() { served <- http.ListenAndServe(*serveHTTP, newHTTPHandler()) }()
+	}
+	fmt.Println("Error serving:", <-served)
+}
+
+// run executes the commands read from r and writes their output to w, one line each
+func run(r io.Reader, w io.Writer) error {
+	output = nil
+
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
@@ -668,31 +1520,94 @@ func main() {
 		command_parts := strings.Fields(line)
 		input_command := command_parts[0]
 
-		if input_command == "in" {
-			finalizeDirectoryOFT()
-			if len(output) > 0 {
-				output = append(output, "")
+		// commands on a whole disk act on the root volume unless given a mount point
+		if diskCommands[input_command] {
+			useVolume(rootVolume)
+		}
+
+		if _, simulated := currentFS.(simulatedFS); !simulated && !portableCommands[input_command] {
+			output = append(output, "error")
+		} else if noTransactionCommands[input_command] && inTransaction() {
+			output = append(output, "error")
+		} else if input_command == "in" {
+			mode := "blocks"
+			if len(command_parts) > 1 {
+				mode = command_parts[1]
+			}
+			if mode != "blocks" && mode != "extent" {
+				output = append(output, "error")
+			} else {
+				if len(output) > 0 {
+					output = append(output, "")
+				}
+				if currentFS.Format(mode) != nil {
+					output = append(output, "error")
+				} else {
+					output = append(output, "system initialized")
+				}
 			}
-			init_fs()
 		} else if input_command == "cr" {
-			if len(command_parts) < 2 {
+			name, ok := "", len(command_parts) > 1
+			if ok {
+				name, ok = selectPath(command_parts[1])
+			}
+			if !ok {
 				output = append(output, "error")
 			} else {
-				create(command_parts[1])
+				create(name)
 			}
 		} else if input_command == "de" {
-			if len(command_parts) < 2 {
+			name, ok := "", len(command_parts) > 1
+			if ok {
+				name, ok = selectPath(command_parts[1])
+			}
+			if !ok {
 				output = append(output, "error")
 			} else {
-				destroy(command_parts[1])
+				destroy(name)
 			}
 		} else if input_command == "dr" {
-			directory()
+			if len(command_parts) > 1 && !selectMount(command_parts[1]) {
+				output = append(output, "error")
+			} else {
+				directory()
+			}
+		} else if input_command == "st" {
+			name, ok := "", len(command_parts) > 1
+			if ok {
+				name, ok = selectPath(command_parts[1])
+			}
+			if !ok {
+				output = append(output, "error")
+			} else {
+				stat(name)
+			}
 		} else if input_command == "op" {
 			if len(command_parts) < 2 {
 				output = append(output, "error")
 			} else {
-				open(command_parts[1])
+				mode := "rw"
+				if len(command_parts) > 2 {
+					mode = command_parts[2]
+				}
+				create := false
+				exclusive := false
+				badFlag := false
+				for _, flag := range command_parts[min(len(command_parts), 3):] {
+					if flag == "c" {
+						create = true
+					} else if flag == "x" {
+						exclusive = true
+					} else {
+						badFlag = true
+					}
+				}
+				name, ok := selectPath(command_parts[1])
+				if badFlag || !ok {
+					output = append(output, "error")
+				} else {
+					open(name, mode, create, exclusive)
+				}
 			}
 		} else if input_command == "cl" {
 			if len(command_parts) < 2 {
@@ -767,22 +1682,220 @@ func main() {
 					read_memory(memOff, cnt)
 				}
 			}
+		} else if input_command == "wmx" || input_command == "wmb" {
+			if len(command_parts) != 3 {
+				output = append(output, "error")
+			} else {
+				memoryOffset, err := strconv.Atoi(command_parts[1])
+				if err != nil {
+					output = append(output, "error")
+				} else if input_command == "wmx" {
+					write_memory_encoded(memoryOffset, "hex", command_parts[2])
+				} else {
+					write_memory_encoded(memoryOffset, "base64", command_parts[2])
+				}
+			}
+		} else if input_command == "rmx" || input_command == "rmb" {
+			if len(command_parts) != 3 {
+				output = append(output, "error")
+			} else {
+				memOff, err1 := strconv.Atoi(command_parts[1])
+				cnt, err2 := strconv.Atoi(command_parts[2])
+				if err1 != nil || err2 != nil {
+					output = append(output, "error")
+				} else if input_command == "rmx" {
+					read_memory_encoded(memOff, cnt, "hex")
+				} else {
+					read_memory_encoded(memOff, cnt, "base64")
+				}
+			}
+		} else if input_command == "lk" {
+			if len(command_parts) < 3 || (len(command_parts) > 3 && command_parts[3] != "nb") {
+				output = append(output, "error")
+			} else {
+				fd, err := strconv.Atoi(command_parts[1])
+				if err != nil {
+					output = append(output, "error")
+				} else {
+					lock_file(fd, command_parts[2], len(command_parts) == 3)
+				}
+			}
+		} else if input_command == "ul" {
+			if len(command_parts) < 2 {
+				output = append(output, "error")
+			} else {
+				fd, err := strconv.Atoi(command_parts[1])
+				if err != nil {
+					output = append(output, "error")
+				} else {
+					unlock_file(fd)
+				}
+			}
+		} else if input_command == "sp" {
+			spawn()
+		} else if input_command == "fk" {
+			fork()
+		} else if input_command == "sw" {
+			if len(command_parts) < 2 {
+				output = append(output, "error")
+			} else {
+				pid, err := strconv.Atoi(command_parts[1])
+				if err != nil {
+					output = append(output, "error")
+				} else {
+					switch_process(pid)
+				}
+			}
+		} else if input_command == "ex" {
+			exit_process()
+		} else if input_command == "cb" {
+			if len(command_parts) < 2 {
+				output = append(output, "error")
+			} else {
+				blockNum, err1 := strconv.Atoi(command_parts[1])
+				offset := 0
+				var err2 error
+				if len(command_parts) > 2 {
+					offset, err2 = strconv.Atoi(command_parts[2])
+				}
+				if err1 != nil || err2 != nil {
+					output = append(output, "error")
+				} else {
+					corrupt_block(blockNum, offset)
+				}
+			}
+		} else if input_command == "snap" || input_command == "rollback" || input_command == "snapdel" || input_command == "snapmount" {
+			if len(command_parts) < 2 {
+				output = append(output, "error")
+			} else if input_command == "snap" {
+				snap(command_parts[1])
+			} else if input_command == "rollback" {
+				rollback(command_parts[1])
+			} else if input_command == "snapdel" {
+				delete_snapshot(command_parts[1])
+			} else {
+				mount_snapshot(command_parts[1])
+			}
+		} else if input_command == "snapumount" {
+			unmount_snapshot()
+		} else if input_command == "io" {
+			io_counts()
+		} else if input_command == "df" {
+			if len(command_parts) > 1 && !selectMount(command_parts[1]) {
+				output = append(output, "error")
+			} else {
+				disk_free()
+			}
+		} else if input_command == "frag" {
+			fragmentation()
+		} else if input_command == "defrag" {
+			defrag()
+		} else if input_command == "hd" || input_command == "pd" {
+			if len(command_parts) < 2 {
+				output = append(output, "error")
+			} else {
+				number, err := strconv.Atoi(command_parts[1])
+				if err != nil {
+					output = append(output, "error")
+				} else if input_command == "hd" {
+					dump_block(number)
+				} else {
+					print_descriptor(number)
+				}
+			}
+		} else if input_command == "pt" {
+			print_oft()
+		} else if input_command == "pm" {
+			if len(command_parts) > 1 && !selectMount(command_parts[1]) {
+				output = append(output, "error")
+			} else {
+				print_allocation_map()
+			}
+		} else if input_command == "sv" || input_command == "ld" {
+			if len(command_parts) < 2 {
+				output = append(output, "error")
+			} else if input_command == "sv" {
+				save_disk(command_parts[1])
+			} else {
+				load_disk(command_parts[1])
+			}
+		} else if input_command == "imp" {
+			name, ok := "", len(command_parts) > 2
+			if ok {
+				name, ok = selectPath(command_parts[2])
+			}
+			if !ok {
+				output = append(output, "error")
+			} else {
+				import_file(command_parts[1], name)
+			}
+		} else if input_command == "exp" {
+			name, ok := "", len(command_parts) > 2
+			if ok {
+				name, ok = selectPath(command_parts[1])
+			}
+			if !ok {
+				output = append(output, "error")
+			} else {
+				export_file(name, command_parts[2])
+			}
+		} else if input_command == "tarx" || input_command == "tari" {
+			if len(command_parts) < 2 || (len(command_parts) > 2 && !selectMount(command_parts[2])) {
+				output = append(output, "error")
+			} else if input_command == "tarx" {
+				archive_files(command_parts[1])
+			} else {
+				extract_files(command_parts[1])
+			}
+		} else if input_command == "begin" {
+			begin_transaction()
+		} else if input_command == "commit" {
+			commit_transaction()
+		} else if input_command == "abort" {
+			abort_transaction()
+		} else if input_command == "mkdisk" {
+			if len(command_parts) < 3 {
+				output = append(output, "error")
+			} else {
+				blocks, err := strconv.Atoi(command_parts[2])
+				mode := "blocks"
+				if len(command_parts) > 3 {
+					mode = command_parts[3]
+				}
+				if err != nil {
+					output = append(output, "error")
+				} else {
+					make_disk(command_parts[1], blocks, mode)
+				}
+			}
+		} else if input_command == "mount" {
+			if len(command_parts) < 3 {
+				output = append(output, "error")
+			} else {
+				mount_disk(command_parts[1], command_parts[2])
+			}
+		} else if input_command == "umount" {
+			if len(command_parts) < 2 {
+				output = append(output, "error")
+			} else {
+				unmount_disk(command_parts[1])
+			}
 		} else {
 			output = append(output, "error")
 		}
 	}
 
-	outputFile, err := os.Create("output.txt")
-	if err != nil {
-		fmt.Println("Error creating output.txt:", err)
-		return
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	// a transaction left open at the end of the input is not committed
+	if inTransaction() {
+		abort_transaction()
 	}
 
-	defer outputFile.Close()
-
-	writer := bufio.NewWriter(outputFile)
+	writer := bufio.NewWriter(w)
 	for i := 0; i < len(output); i++ {
 		writer.WriteString(output[i] + "\n")
 	}
-	writer.Flush()
+	return writer.Flush()
 }
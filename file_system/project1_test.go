@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestImportExport copies a host file holding every byte value in and back out
+func TestImportExport(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.bin")
+	exported := filepath.Join(dir, "out.bin")
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(in, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := runScript(t, "in", "imp "+in+" f", "dr", "op f r", "sk 1 1", "rd 1 0 3", "rm 0 3", "cl 1", "exp f "+exported)
+	want := []string{"system initialized", "1000 bytes imported to f", "f 1000", "f opened 1",
+		"position is 1", "3 bytes read from 1", "\a\x0e\x15", "1 closed", "1000 bytes exported from f"}
+	if len(out) != len(want) {
+		t.Fatalf("output %q", out)
+	}
+	for i := range want {
+		if out[i] != want[i] {
+			t.Errorf("line %d: %q, want %q", i, out[i], want[i])
+		}
+	}
+	got, err := os.ReadFile(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("exported %d bytes, not the imported ones", len(got))
+	}
+}
+
+// TestEncodedMemory writes and reads memory as hex and base64
+func TestEncodedMemory(t *testing.T) {
+	checkScript(t, []string{
+		"in", "cr bin", "op bin rw", "wmx 0 00ff10", "wmb 3 aGk=", "wr 1 0 5", "sk 1 0", "rd 1 100 5",
+		"rmx 100 5", "rmb 100 5", "wmx 0 zz", "wmb 0 !!", "rmx 100 5 5", "rmb 100", "st bin",
+	}, []string{
+		"system initialized", "bin created", "bin opened 1", "3 bytes written to M",
+		"2 bytes written to M", "5 bytes written to 1", "position is 0", "5 bytes read from 1",
+		"00ff106869", "AP8QaGk=", "error", "error", "error", "error", "bin size 5 blocks 1",
+	})
+}
+
+// TestSparseFile writes past the end in blocks mode, the hole reads as zeros and gets
+// no block until it is written
+func TestSparseFile(t *testing.T) {
+	checkScript(t, []string{
+		"in", "cr s", "op s rw", "sk 1 1000", "wm 0 abc", "wr 1 0 3", "st s", "df", "sk 1 510",
+		"rd 1 10 4", "rmx 10 4", "sk 1 1000", "rd 1 20 3", "rm 20 3", "sk 1 0", "wr 1 0 3", "st s",
+	}, []string{
+		"system initialized", "s created", "s opened 1", "position is 1000", "3 bytes written to M",
+		"3 bytes written to 1", "s size 1003 blocks 1", "blocks 56 used 1 free 55 largest free run 55",
+		"descriptors 191 used 1 free 190", "directory slots 192 used 1 free 191", "position is 510",
+		"4 bytes read from 1", "00000000", "position is 1000", "3 bytes read from 1", "abc",
+		"position is 0", "3 bytes written to 1", "s size 1003 blocks 2",
+	})
+}
+
+// TestOpenModes checks each open mode and the create and exclusive flags
+func TestOpenModes(t *testing.T) {
+	checkScript(t, []string{
+		"in", "cr a", "op a r", "wm 0 abc", "wr 1 0 3", "cl 1", "op a w", "wr 1 0 3", "cl 1", "op a a",
+		"wm 0 def", "wr 1 0 3", "sk 1 0", "wr 1 0 3", "cl 1", "op a rw", "rd 1 10 9", "rm 10 9", "st a",
+		"cl 1", "op b", "op b rw c", "op b rw c x", "op a rw c x", "cl 1", "op nofile r c", "op a zz",
+		"st zz", "dr",
+	}, []string{
+		"system initialized", "a created", "a opened 1", "3 bytes written to M", "error", "1 closed",
+		"a opened 1", "3 bytes written to 1", "1 closed", "a opened 1", "3 bytes written to M",
+		"3 bytes written to 1", "position is 0", "3 bytes written to 1", "1 closed", "a opened 1",
+		"9 bytes read from 1", "abcdefdef", "a size 9 blocks 1", "1 closed", "error", "b opened 1",
+		"error", "error", "1 closed", "error", "error", "error", "a 9 b 0",
+	})
+}
+
+// TestProcesses forks and exits processes, a slot stays open while a descriptor table
+// still refers to it
+func TestProcesses(t *testing.T) {
+	checkScript(t, []string{
+		"in", "cr a", "op a r", "sp", "sw 1", "op a r", "fk", "sw 2", "cl 1", "pt", "ex", "sw 1", "ex",
+		"sw 0", "pt", "sw 7", "ex",
+	}, []string{
+		"system initialized", "a created", "a opened 1", "process 1 spawned", "process 1 running",
+		"a opened 1", "process 2 forked", "process 2 running", "1 closed",
+		"slot 0 descriptor 0 position 0 size 8 block 0 mode rw refs 0",
+		"slot 1 descriptor 1 position 0 size 0 block 0 mode r refs 1",
+		"slot 2 descriptor 1 position 0 size 0 block 0 mode r refs 1", "slot 3 free", "process 2 exited",
+		"process 1 running", "process 1 exited", "process 0 running",
+		"slot 0 descriptor 0 position 0 size 8 block 0 mode rw refs 0",
+		"slot 1 descriptor 1 position 0 size 0 block 0 mode r refs 1", "slot 2 free", "slot 3 free",
+		"error", "error",
+	})
+}
+
+// TestCorruptBlock damages a block of a file, opening the file reports the checksum error
+func TestCorruptBlock(t *testing.T) {
+	checkScript(t, []string{
+		"in", "cr a", "op a rw", "wm 0 data", "wr 1 0 4", "cl 1", "cb 8 2", "op a r", "cb 99", "io",
+		"df",
+	}, []string{
+		"system initialized", "a created", "a opened 1", "4 bytes written to M", "4 bytes written to 1",
+		"1 closed", "block 8 corrupted", "checksum error", "error", "1 block reads 3 block writes",
+		"blocks 56 used 1 free 55 largest free run 55", "descriptors 191 used 1 free 190",
+		"directory slots 192 used 1 free 191",
+	})
+}
+
+// TestCorruptDirectory damages the directory block a snapshot shares, mounting or
+// rolling back to the snapshot reports the checksum error and so does every command
+// needing the directory afterwards, instead of handing out descriptors a lost entry owns
+func TestCorruptDirectory(t *testing.T) {
+	checkScript(t, []string{
+		"in", "cr a", "snap s", "cb 7 0", "snapmount s", "rollback s", "dr", "cr b", "op b rw c", "op a r",
+		"de a", "snapumount",
+	}, []string{
+		"system initialized", "a created", "snapshot s created", "block 7 corrupted", "checksum error",
+		"checksum error", "checksum error", "checksum error", "checksum error", "checksum error",
+		"checksum error", "error",
+	})
+}
+
+// TestDiskFull fills the disk, the write that runs out of blocks reports the bytes it
+// stored before the disk filled up
+func TestDiskFull(t *testing.T) {
+	// 18 files of three blocks leave two of the 56 data blocks for x
+	script := []string{"in"}
+	for i := 0; i < 18; i++ {
+		name := strconv.Itoa(10 + i)
+		script = append(script, "cr "+name, "op "+name+" w", "wr 1 0 512", "wr 1 0 512", "wr 1 0 512", "cl 1")
+	}
+	script = append(script, "cr x", "op x w", "sk 1 300", "wr 1 0 500", "wr 1 0 500", "wr 1 0 1", "cl 1", "st x", "df")
+	out := runScript(t, script...)
+	want := []string{"x created", "x opened 1", "position is 300", "500 bytes written to 1",
+		"224 bytes written to 1, disk full", "0 bytes written to 1, disk full", "1 closed", "x size 1024 blocks 2",
+		"blocks 56 used 56 free 0 largest free run 0", "descriptors 191 used 19 free 172",
+		"directory slots 192 used 19 free 173"}
+	if got := strings.Join(out[len(out)-len(want):], "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("output:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+// TestDamagedDirectoryEntry points an entry past the descriptor table, the commands
+// reaching the file through it fail instead of reading some other descriptor
+func TestDamagedDirectoryEntry(t *testing.T) {
+	runScript(t, "in", "cr a")
+	entry := dirNameIndex["a"]
+	entry.descriptor = 192
+	dirNameIndex["a"] = entry
+
+	dir := t.TempDir()
+	out := runScript(t, "dr", "st a", "op a r", "de a", "exp a "+filepath.Join(dir, "a"), "tarx "+filepath.Join(dir, "a.tar"))
+	for i, line := range out {
+		if line != "error" {
+			t.Errorf("command %d: %q", i, line)
+		}
+	}
+}
+
+// TestCorruptSecondDirectoryBlock damages the block holding the entries past the first
+// 64, the directory fails to load instead of losing those entries
+func TestCorruptSecondDirectoryBlock(t *testing.T) {
+	script := []string{"in"}
+	for i := 10; i < 80; i++ {
+		script = append(script, "cr "+strconv.Itoa(i))
+	}
+	script = append(script, "snap s", "pd 0", "cb 8 0", "snapmount s", "rollback s")
+	out := runScript(t, script...)
+	want := []string{"descriptor 0 size 560 blocks 7 8 0", "block 8 corrupted", "checksum error", "checksum error"}
+	if got := strings.Join(out[len(out)-len(want):], "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("output:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+// TestAbortAcrossVolumes aborts a transaction that wrote to two volumes, both are back
+// to the state at begin while their disks were never copied
+func TestAbortAcrossVolumes(t *testing.T) {
+	checkScript(t, []string{
+		"in", "mkdisk d 16", "mount d /d", "cr /d/a", "cr r", "begin", "cr /d/b", "op /d/a rw", "wm 0 abc",
+		"wr 1 0 3", "cl 1", "cr s", "abort", "dr /d", "dr", "op /d/a r", "rd 1 0 3",
+	}, []string{
+		"system initialized", "disk d created with 16 blocks", "d mounted on /d", "a created", "r created",
+		"transaction started", "b created", "a opened 1", "3 bytes written to M", "3 bytes written to 1",
+		"1 closed", "s created", "transaction aborted", "a 0", "r 0", "a opened 1", "0 bytes read from 1",
+	})
+}
+
+// TestDirectorySlotsReused creates and destroys more files than the directory has
+// slots, the slot of a destroyed file is taken again instead of growing the directory
+func TestDirectorySlotsReused(t *testing.T) {
+	script := []string{"in", "cr a"}
+	for i := 0; i < 300; i++ {
+		script = append(script, "cr x", "de x")
+	}
+	out := runScript(t, append(script, "cr b", "dr", "pd 0", "df")...)
+	want := []string{"b created", "a 0 b 0", "descriptor 0 size 16 blocks 7 0 0",
+		"blocks 56 used 0 free 56 largest free run 56", "descriptors 191 used 2 free 189",
+		"directory slots 192 used 2 free 190"}
+	if got := strings.Join(out[len(out)-len(want):], "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("output:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+// SNAPSHOT FUNCTIONS
+//
+// A snapshot is a copy of the descriptors only. The blocks they point to are shared
+// with the live file system and counted in blockRefCount, and writableBlock copies a
+// shared block before it is changed, so taking a snapshot costs no data blocks.
+
+var snapshots = make(map[string][192][4]int)
+
+// while a snapshot is mounted the live descriptors wait here and nothing may change
+var mountedSnapshot string
+var liveDescriptors [192][4]int
+
+func resetSnapshots() {
+	snapshots = make(map[string][192][4]int)
+	mountedSnapshot = ""
+	for b := 0; b < 64; b++ {
+		blockRefCount[b] = 0
+	}
+}
+
+// anyFileOpen reports whether a file of the active volume is open
+func anyFileOpen() bool {
+	for i := 1; i < 4; i++ {
+		if oftValid[i] && oftVolume[i] == activeVolume {
+			return true
+		}
+	}
+	return false
+}
+
+// countSnapshotBlocks adds delta to the reference count of every block a snapshot uses
+func countSnapshotBlocks(snapshot [192][4]int, delta int) {
+	for i := 0; i < 192; i++ {
+		for _, blockNum := range descriptorBlocks(snapshot[i]) {
+			blockRefCount[blockNum] += delta
+		}
+	}
+}
+
+// snap freezes the current state of the disk under name
+func snap(name string) {
+	if _, exists := snapshots[name]; exists || mountedSnapshot != "" {
+		output = append(output, "error")
+		return
+	}
+
+	allocMu.Lock()
+	snapshot := descriptors
+	countSnapshotBlocks(snapshot, 1)
+	allocMu.Unlock()
+
+	snapshots[name] = snapshot
+	output = append(output, "snapshot "+name+" created")
+}
+
+// rollback makes a snapshot the live state again, the snapshot itself is kept
+func rollback(name string) {
+	snapshot, exists := snapshots[name]
+	if !exists || mountedSnapshot != "" || anyFileOpen() {
+		output = append(output, "error")
+		return
+	}
+
+	dirMu.Lock()
+	allocMu.Lock()
+	live := descriptors
+	descriptors = snapshot
+	allocMu.Unlock()
+	loaded := initializeDirectoryOFT()
+	if !loaded {
+		allocMu.Lock()
+		descriptors = live
+		allocMu.Unlock()
+		initializeDirectoryOFT()
+	}
+	dirMu.Unlock()
+
+	if !loaded {
+		output = append(output, "checksum error")
+		return
+	}
+	output = append(output, "rolled back to "+name)
+}
+
+// delete_snapshot forgets a snapshot, blocks only it referred to become free
+func delete_snapshot(name string) {
+	snapshot, exists := snapshots[name]
+	if !exists || mountedSnapshot == name {
+		output = append(output, "error")
+		return
+	}
+
+	allocMu.Lock()
+	countSnapshotBlocks(snapshot, -1)
+	allocMu.Unlock()
+
+	delete(snapshots, name)
+	output = append(output, "snapshot "+name+" deleted")
+}
+
+// mount_snapshot shows a snapshot in place of the live files, read-only
+func mount_snapshot(name string) {
+	snapshot, exists := snapshots[name]
+	if !exists || mountedSnapshot != "" || anyFileOpen() {
+		output = append(output, "error")
+		return
+	}
+
+	dirMu.Lock()
+	allocMu.Lock()
+	liveDescriptors = descriptors
+	descriptors = snapshot
+	allocMu.Unlock()
+	loaded := initializeDirectoryOFT()
+	if loaded {
+		mountedSnapshot = name
+	} else {
+		allocMu.Lock()
+		descriptors = liveDescriptors
+		allocMu.Unlock()
+		initializeDirectoryOFT()
+	}
+	dirMu.Unlock()
+
+	if !loaded {
+		output = append(output, "checksum error")
+		return
+	}
+	output = append(output, "snapshot "+name+" mounted")
+}
+
+func unmount_snapshot() {
+	if mountedSnapshot == "" || anyFileOpen() {
+		output = append(output, "error")
+		return
+	}
+
+	dirMu.Lock()
+	allocMu.Lock()
+	descriptors = liveDescriptors
+	allocMu.Unlock()
+	loaded := initializeDirectoryOFT()
+	name := mountedSnapshot
+	mountedSnapshot = ""
+	dirMu.Unlock()
+
+	if !loaded {
+		output = append(output, "checksum error")
+		return
+	}
+	output = append(output, "snapshot "+name+" unmounted")
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+// TestSnapshots changes a file after a snapshot, the mounted snapshot and a rollback
+// show the old contents
+func TestSnapshots(t *testing.T) {
+	checkScript(t, []string{
+		"in", "cr a", "op a rw", "wm 0 original", "wr 1 0 8", "cl 1", "snap s1", "op a rw",
+		"wm 0 modified", "wr 1 0 8", "cl 1", "pm", "snapmount s1", "op a rw", "op a r", "rd 1 20 8",
+		"rm 20 8", "cr b", "cl 1", "snapumount", "op a r", "rd 1 20 8", "rm 20 8", "cl 1", "rollback s1",
+		"op a r", "rd 1 20 8", "rm 20 8", "cl 1", "snapdel s1", "snapdel s1", "defrag", "pm",
+	}, []string{
+		"system initialized", "a created", "a opened 1", "8 bytes written to M", "8 bytes written to 1",
+		"1 closed", "snapshot s1 created", "a opened 1", "8 bytes written to M", "8 bytes written to 1",
+		"1 closed", "00 -------ds#......", "16 ................", "32 ................",
+		"48 ................", "snapshot s1 mounted", "error", "a opened 1", "8 bytes read from 1",
+		"original", "error", "1 closed", "snapshot s1 unmounted", "a opened 1", "8 bytes read from 1",
+		"modified", "1 closed", "rolled back to s1", "a opened 1", "8 bytes read from 1", "original",
+		"1 closed", "snapshot s1 deleted", "error", "0 blocks moved, fragments before 1 after 1",
+		"00 -------d#.......", "16 ................", "32 ................", "48 ................",
+	})
+}
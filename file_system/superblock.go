@@ -0,0 +1,333 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// SUPERBLOCK FUNCTIONS
+//
+// Block 0 describes the disk. Its first half holds the superblock fields below as
+// 4 byte integers, its second half the block checksums kept by write_block.
+// Blocks 1-6 hold the descriptors when the disk is saved, block 7 starts the root
+// directory and data blocks follow.
+
+const superblockMagic = 0x4f534653 // "OSFS"
+const formatVersion = 1
+const firstDescriptorBlock = 1
+const descriptorBlockCount = 6
+const rootDirectoryDescriptor = 0
+const rootDirectoryBlock = 7
+const firstDataBlock = 8
+
+// byte offsets of the superblock fields in block 0, bytes 40-47 held free counts that
+// went stale with every write and are left zero
+const (
+	sbMagic           = 0
+	sbVersion         = 4
+	sbBlockCount      = 8
+	sbBlockSize       = 12
+	sbDescriptorBlock = 16
+	sbDescriptorSpan  = 20
+	sbDescriptorCount = 24
+	sbRootDescriptor  = 28
+	sbRootBlock       = 32
+	sbFirstDataBlock  = 36
+	sbAllocationMode  = 48
+)
+
+func superblockField(block []int, pos int) int {
+	return convertBytesToInteger(block[pos], block[pos+1], block[pos+2], block[pos+3])
+}
+
+// countFreeDescriptors must be called with dirMu held
+func countFreeDescriptors() int {
+	free := 0
+	for i := 1; i < 192; i++ {
+		if desc, _ := readDescriptor(i); desc == [4]int{} && !descriptorInDirectory(i) {
+			free++
+		}
+	}
+	return free
+}
+
+func countFreeBlocks() int {
+	allocMu.Lock()
+	defer allocMu.Unlock()
+	return 64 - len(blocksInUse())
+}
+
+// largestFreeRun returns the length of the longest run of free data blocks
+func largestFreeRun() int {
+	allocMu.Lock()
+	usedBlocks := blocksInUse()
+	allocMu.Unlock()
+
+	largest := 0
+	run := 0
+	for blockNum := firstDataBlock; blockNum < 64; blockNum++ {
+		if usedBlocks[blockNum] {
+			run = 0
+			continue
+		}
+		run++
+		if run > largest {
+			largest = run
+		}
+	}
+	return largest
+}
+
+// disk_free reports the space left on the disk like df: data blocks, file descriptors
+// and directory slots, used and free
+func disk_free() {
+	dirMu.Lock()
+	freeDescriptors := countFreeDescriptors()
+	usedSlots := len(dirNameIndex)
+	dirMu.Unlock()
+	totalSlots := maxDirectorySize / 8
+
+	totalBlocks := diskBlocks - firstDataBlock
+	freeBlocks := countFreeBlocks()
+	output = append(output, "blocks "+strconv.Itoa(totalBlocks)+" used "+strconv.Itoa(totalBlocks-freeBlocks)+" free "+strconv.Itoa(freeBlocks)+" largest free run "+strconv.Itoa(largestFreeRun()))
+	output = append(output, "descriptors 191 used "+strconv.Itoa(191-freeDescriptors)+" free "+strconv.Itoa(freeDescriptors))
+	output = append(output, "directory slots "+strconv.Itoa(totalSlots)+" used "+strconv.Itoa(usedSlots)+" free "+strconv.Itoa(totalSlots-usedSlots))
+}
+
+// writeSuperblock records the geometry in block 0
+func writeSuperblock() {
+	mode := 0
+	if allocationMode == "extent" {
+		mode = 1
+	}
+	fields := map[int]int{
+		sbMagic:           superblockMagic,
+		sbVersion:         formatVersion,
+		sbBlockCount:      diskBlocks,
+		sbBlockSize:       512,
+		sbDescriptorBlock: firstDescriptorBlock,
+		sbDescriptorSpan:  descriptorBlockCount,
+		sbDescriptorCount: 192,
+		sbRootDescriptor:  rootDirectoryDescriptor,
+		sbRootBlock:       rootDirectoryBlock,
+		sbFirstDataBlock:  firstDataBlock,
+		sbAllocationMode:  mode,
+	}
+	for pos, val := range fields {
+		convertIntegerToBytes(val, disk[0][:], pos)
+	}
+}
+
+// validSuperblock checks that block 0 of an image describes a disk this program formats
+func validSuperblock(block []int) bool {
+	expected := map[int]int{
+		sbMagic:           superblockMagic,
+		sbVersion:         formatVersion,
+		sbBlockSize:       512,
+		sbDescriptorBlock: firstDescriptorBlock,
+		sbDescriptorSpan:  descriptorBlockCount,
+		sbDescriptorCount: 192,
+		sbRootDescriptor:  rootDirectoryDescriptor,
+		sbRootBlock:       rootDirectoryBlock,
+		sbFirstDataBlock:  firstDataBlock,
+	}
+	for pos, val := range expected {
+		if superblockField(block, pos) != val {
+			return false
+		}
+	}
+	blocks := superblockField(block, sbBlockCount)
+	mode := superblockField(block, sbAllocationMode)
+	return blocks > firstDataBlock && blocks <= 64 && (mode == 0 || mode == 1)
+}
+
+// storeDescriptors writes the descriptor table into blocks 1-6
+func storeDescriptors() {
+	var blocks [descriptorBlockCount][512]int
+	for i := 0; i < 192; i++ {
+		desc, _ := readDescriptor(i)
+		for j := 0; j < 4; j++ {
+			pos := (i*4 + j) * 4
+			convertIntegerToBytes(desc[j], blocks[pos/512][:], pos%512)
+		}
+	}
+	for b := 0; b < descriptorBlockCount; b++ {
+		writeBlock(firstDescriptorBlock+b, blocks[b][:])
+	}
+}
+
+// loadDescriptors decodes the descriptor table from blocks 1-6 of an image
+func loadDescriptors(image *[64][512]int) [192][4]int {
+	var table [192][4]int
+	for i := 0; i < 192; i++ {
+		for j := 0; j < 4; j++ {
+			pos := (i*4 + j) * 4
+			block := image[firstDescriptorBlock+pos/512][:]
+			table[i][j] = superblockField(block, pos%512)
+		}
+	}
+	return table
+}
+
+// validDescriptor checks that a loaded descriptor only points at blocks of a disk of
+// the given size it may use
+func validDescriptor(i int, desc [4]int, mode string, blocks int) bool {
+	lowest := firstDataBlock
+	if i == rootDirectoryDescriptor {
+		lowest = rootDirectoryBlock
+	}
+	if desc[0] < 0 || desc[0] > 3*512 {
+		return false
+	}
+	if mode == "extent" {
+		if desc[1] == 0 {
+			return desc[2] == 0 && desc[3] == 0
+		}
+		return desc[1] >= lowest && desc[2] >= 1 && desc[3] >= 0 && desc[3]+desc[2] <= 3 && desc[1]+desc[2] <= blocks
+	}
+	for j := 1; j < 4; j++ {
+		if desc[j] != 0 && (desc[j] < lowest || desc[j] >= blocks) {
+			return false
+		}
+	}
+	return true
+}
+
+// crossLinked reports whether two block pointers of a descriptor table, in one
+// descriptor or in two, lead to the same block
+func crossLinked(table *[192][4]int, mode string) bool {
+	used := make(map[int]bool)
+	for i := 0; i < 192; i++ {
+		blocks := []int{}
+		if mode == "extent" {
+			for b := table[i][1]; b != 0 && b < table[i][1]+table[i][2]; b++ {
+				blocks = append(blocks, b)
+			}
+		} else {
+			for j := 1; j < 4; j++ {
+				if table[i][j] != 0 {
+					blocks = append(blocks, table[i][j])
+				}
+			}
+		}
+		for _, b := range blocks {
+			if used[b] {
+				return true
+			}
+			used[b] = true
+		}
+	}
+	return false
+}
+
+// save_disk writes the whole disk, descriptors and superblock included, to a host file
+func save_disk(hostPath string) {
+	storeDescriptors()
+	writeSuperblock()
+
+	content := make([]byte, 0, 64*512)
+	for b := 0; b < 64; b++ {
+		for i := 0; i < 512; i++ {
+			content = append(content, byte(disk[b][i]))
+		}
+	}
+	if err := os.WriteFile(hostPath, content, 0644); err != nil {
+		output = append(output, "error")
+		return
+	}
+	output = append(output, "disk saved")
+}
+
+// load_disk replaces the disk with an image written by save_disk. Nothing changes
+// unless the superblock, every block checksum and every descriptor are valid and no
+// block belongs to two files.
+func load_disk(hostPath string) {
+	content, err := os.ReadFile(hostPath)
+	if err != nil {
+		output = append(output, "error")
+		return
+	}
+
+	var image [64][512]int
+	if len(content) != 64*512 {
+		output = append(output, "invalid disk")
+		return
+	}
+	for b := 0; b < 64; b++ {
+		for i := 0; i < 512; i++ {
+			image[b][i] = int(content[b*512+i])
+		}
+	}
+	if !validSuperblock(image[0][:]) {
+		output = append(output, "invalid disk")
+		return
+	}
+	for b := 1; b < 64; b++ {
+		if blockChecksum(image[b][:]) != superblockField(image[0][:], 256+4*b) {
+			output = append(output, "invalid disk")
+			return
+		}
+	}
+
+	mode := "blocks"
+	if superblockField(image[0][:], sbAllocationMode) == 1 {
+		mode = "extent"
+	}
+	blocks := superblockField(image[0][:], sbBlockCount)
+	table := loadDescriptors(&image)
+	for i := 0; i < 192; i++ {
+		if !validDescriptor(i, table[i], mode, blocks) {
+			output = append(output, "invalid disk")
+			return
+		}
+	}
+	if crossLinked(&table, mode) {
+		output = append(output, "invalid disk")
+		return
+	}
+
+	// the directory has a block for every entry, and every entry in it has to name a
+	// real file descriptor
+	root := table[rootDirectoryDescriptor]
+	dirSize := root[0]
+	if root[1] == 0 || (mode == "extent" && root[3] != 0) || dirSize%8 != 0 || dirSize > maxDirectorySize {
+		output = append(output, "invalid disk")
+		return
+	}
+	for pos := 0; pos < dirSize; pos += 8 {
+		blockIndex := pos / 512
+		blockNum := root[1+blockIndex]
+		if mode == "extent" {
+			blockNum = 0
+			if blockIndex < root[2] {
+				blockNum = root[1] + blockIndex
+			}
+		}
+		if blockNum == 0 {
+			output = append(output, "invalid disk")
+			return
+		}
+		dirBlock := image[blockNum][:]
+		offset := pos % 512
+		index := superblockField(dirBlock, offset+4)
+		named := dirBlock[offset] != 0 || dirBlock[offset+1] != 0 || dirBlock[offset+2] != 0 || dirBlock[offset+3] != 0
+		if named && (index < 1 || index >= 192) {
+			output = append(output, "invalid disk")
+			return
+		}
+	}
+
+	allocMu.Lock()
+	disk = image
+	descriptors = table
+	allocMu.Unlock()
+	allocationMode = mode
+	diskBlocks = blocks
+	resetOpenFiles()
+	resetIOCounts()
+	if !initializeDirectoryOFT() {
+		output = append(output, "checksum error")
+		return
+	}
+	output = append(output, "disk loaded with "+strconv.Itoa(countFreeBlocks())+" free blocks")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// descriptorOffset is where field j of descriptor i starts in a saved image
+func descriptorOffset(i int, j int) int {
+	return firstDescriptorBlock*512 + (i*4+j)*4
+}
+
+// patchDescriptor sets a field of a descriptor in a saved image and fixes the checksum
+// of the block holding it, so only the descriptor checks can refuse the image
+func patchDescriptor(image []byte, i int, j int, val int) {
+	b := descriptorOffset(i, j) / 512
+	block := make([]int, 512)
+	for k := range block {
+		block[k] = int(image[b*512+k])
+	}
+	convertIntegerToBytes(val, block, descriptorOffset(i, j)%512)
+	checksum := make([]int, 4)
+	convertIntegerToBytes(blockChecksum(block), checksum, 0)
+	for k := range block {
+		image[b*512+k] = byte(block[k])
+	}
+	for k := range checksum {
+		image[256+4*b+k] = byte(checksum[k])
+	}
+}
+
+// setBlockCount changes the number of blocks the superblock of a saved image reports
+func setBlockCount(image []byte, blocks int) {
+	field := make([]int, 4)
+	convertIntegerToBytes(blocks, field, 0)
+	for k := range field {
+		image[sbBlockCount+k] = byte(field[k])
+	}
+}
+
+// TestSaveLoad saves a disk and loads it back after in, then checks that images with
+// a block shared by two pointers or a pointer past the disk are refused
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	out := runScript(t, "in", "cr a", "op a rw", "wm 0 hello", "wr 1 0 5", "sk 1 600", "wr 1 0 5", "cl 1",
+		"cr b", "op b rw", "wr 1 0 3", "cl 1", "sv "+path,
+		"in", "ld "+path, "dr", "op a r", "sk 1 600", "rd 1 20 5", "rm 20 5", "cl 1")
+	want := []string{"disk saved", "", "system initialized", "disk loaded with 53 free blocks", "a 605 b 3",
+		"a opened 1", "position is 600", "5 bytes read from 1", "hello", "1 closed"}
+	if got := strings.Join(out[len(out)-len(want):], "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("round trip:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first block of a, blocks are below 64 and fit into the last byte
+	first := int(saved[descriptorOffset(1, 1)+3])
+	bad := map[string]func(image []byte){
+		"two files": func(image []byte) { patchDescriptor(image, 2, 1, first) },
+		"one file":  func(image []byte) { patchDescriptor(image, 1, 3, first) },
+		"past the disk": func(image []byte) {
+			setBlockCount(image, 16)
+			patchDescriptor(image, 2, 2, 40)
+		},
+	}
+	for name, patch := range bad {
+		image := append([]byte(nil), saved...)
+		patch(image)
+		if err := os.WriteFile(path, image, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out := runScript(t, "in", "ld "+path); out[1] != "invalid disk" {
+			t.Errorf("%s: %q", name, out)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"maps"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// TRANSACTION FUNCTIONS
+//
+// Between begin and commit, block writes are held in memory instead of going to the
+// disk, and commit writes them all at once. The descriptors, the directory and the OFT
+// live in memory anyway, begin keeps a copy of them for every volume, and abort puts
+// the copies back and drops the held blocks. The disks are not copied, they do not
+// change until commit.
+
+// transaction is the state at begin and the blocks written since, by volume
+type transaction struct {
+	metadata     map[string]volumeMetadata
+	mountTable   map[string]string
+	activeVolume string
+	openFiles    openFileState
+	blocks       map[string]map[int][512]int
+}
+
+// openFileState is the OFT and the descriptor tables of the processes
+type openFileState struct {
+	oftBuffer          [4][512]int
+	oftCurrentPosition [4]int
+	oftFileSize        [4]int
+	oftDescriptorIndex [4]int
+	oftValid           [4]bool
+	oftLoadedBlock     [4]int
+	oftMode            [4]string
+	oftRefCount        [4]int
+	oftVolume          [4]string
+	procValid          [8]bool
+	procFD             [8][8]int
+	currentProc        int
+}
+
+// txMu is a leaf lock guarding currentTx and its blocks
+var txMu sync.Mutex
+var currentTx *transaction
+
+// noTransactionCommands would write the disk past the held blocks, hold locks that an
+// abort cannot give back or, like in, throw the transaction away unnoticed
+var noTransactionCommands = map[string]bool{"in": true, "sv": true, "ld": true, "mkdisk": true, "lk": true, "ul": true}
+
+func resetTransaction() {
+	txMu.Lock()
+	currentTx = nil
+	txMu.Unlock()
+}
+
+func inTransaction() bool {
+	txMu.Lock()
+	defer txMu.Unlock()
+	return currentTx != nil
+}
+
+// bufferedBlock returns a block of the active volume written during the transaction
+func bufferedBlock(blockNum int) ([512]int, bool) {
+	txMu.Lock()
+	defer txMu.Unlock()
+	if currentTx == nil {
+		return [512]int{}, false
+	}
+	block, buffered := currentTx.blocks[activeVolume][blockNum]
+	return block, buffered
+}
+
+// bufferBlock holds a block write back until commit, false outside a transaction
+func bufferBlock(blockNum int, buffer []int) bool {
+	txMu.Lock()
+	defer txMu.Unlock()
+	if currentTx == nil || blockNum < 0 || blockNum >= 64 {
+		return false
+	}
+	if currentTx.blocks[activeVolume] == nil {
+		currentTx.blocks[activeVolume] = make(map[int][512]int)
+	}
+	var block [512]int
+	copy(block[:], buffer)
+	currentTx.blocks[activeVolume][blockNum] = block
+	return true
+}
+
+func saveOpenFiles() openFileState {
+	return openFileState{oftBuffer, oftCurrentPosition, oftFileSize, oftDescriptorIndex, oftValid,
+		oftLoadedBlock, oftMode, oftRefCount, oftVolume, procValid, procFD, currentProc}
+}
+
+func restoreOpenFiles(state openFileState) {
+	oftBuffer = state.oftBuffer
+	oftCurrentPosition = state.oftCurrentPosition
+	oftFileSize = state.oftFileSize
+	oftDescriptorIndex = state.oftDescriptorIndex
+	oftValid = state.oftValid
+	oftLoadedBlock = state.oftLoadedBlock
+	oftMode = state.oftMode
+	oftRefCount = state.oftRefCount
+	oftVolume = state.oftVolume
+	procValid = state.procValid
+	procFD = state.procFD
+	currentProc = state.currentProc
+}
+
+// copyMetadata copies the metadata of a volume together with its maps
+func copyMetadata(v *volume) volumeMetadata {
+	c := v.volumeMetadata
+	c.snapshots = maps.Clone(v.snapshots)
+	c.dirNameIndex = maps.Clone(v.dirNameIndex)
+	c.dirEntryIndex = maps.Clone(v.dirEntryIndex)
+	return c
+}
+
+// anyLockHeld reports whether a lock is held or waited for, an abort could not undo it
+func anyLockHeld() bool {
+	flockMu.Lock()
+	defer flockMu.Unlock()
+	for i := 1; i < 4; i++ {
+		if oftLockMode[i] != "" {
+			return true
+		}
+	}
+	return len(lockWaiters) > 0
+}
+
+// begin_transaction starts buffering, transactions do not nest
+func begin_transaction() {
+	if inTransaction() || anyLockHeld() {
+		output = append(output, "error")
+		return
+	}
+
+	lockAll()
+	storeVolume(volumes[activeVolume])
+	tx := &transaction{
+		metadata:     make(map[string]volumeMetadata),
+		mountTable:   maps.Clone(mountTable),
+		activeVolume: activeVolume,
+		openFiles:    saveOpenFiles(),
+		blocks:       make(map[string]map[int][512]int),
+	}
+	for name, v := range volumes {
+		tx.metadata[name] = copyMetadata(v)
+	}
+	unlockAll()
+
+	txMu.Lock()
+	currentTx = tx
+	txMu.Unlock()
+	output = append(output, "transaction started")
+}
+
+// commit_transaction writes the held blocks to their volumes, in block order
+func commit_transaction() {
+	txMu.Lock()
+	tx := currentTx
+	currentTx = nil
+	txMu.Unlock()
+	if tx == nil {
+		output = append(output, "error")
+		return
+	}
+
+	names := make([]string, 0, len(tx.blocks))
+	for name := range tx.blocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	previous := activeVolume
+	written := 0
+	for _, name := range names {
+		useVolume(name)
+		blockNums := make([]int, 0, len(tx.blocks[name]))
+		for blockNum := range tx.blocks[name] {
+			blockNums = append(blockNums, blockNum)
+		}
+		sort.Ints(blockNums)
+		for _, blockNum := range blockNums {
+			block := tx.blocks[name][blockNum]
+			write_block(blockNum, block[:])
+			written++
+		}
+	}
+	useVolume(previous)
+	output = append(output, "transaction committed, "+strconv.Itoa(written)+" blocks written")
+}
+
+// abort_transaction drops the held blocks and puts back the state from begin
+func abort_transaction() {
+	txMu.Lock()
+	tx := currentTx
+	currentTx = nil
+	txMu.Unlock()
+	if tx == nil {
+		output = append(output, "error")
+		return
+	}
+
+	lockAll()
+	storeVolume(volumes[activeVolume])
+	for name, v := range volumes {
+		if meta, existed := tx.metadata[name]; existed {
+			v.volumeMetadata = meta
+		} else {
+			delete(volumes, name)
+		}
+	}
+	mountTable = tx.mountTable
+	activeVolume = tx.activeVolume
+	restoreVolume(volumes[activeVolume])
+	restoreOpenFiles(tx.openFiles)
+	unlockAll()
+	output = append(output, "transaction aborted")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// VIRTUAL FILE SYSTEM
+//
+// The file commands of the interpreter (in cr de op cl rd wr sk dr) go through the
+// fileSystem interface, so a script can run against the simulated disk or, with
+// -host, against real files in a host directory. Comparing the two outputs shows where
+// the simulated semantics differ from the host's. Handles are small numbers starting
+// at 1, errors are errFS or one of the more specific errors of api.go. A handle can be
+// shared, Dup adds a reference for a forked descriptor and Close drops one, only the
+// last Close closes the file.
+
+type fileSystem interface {
+	Format(mode string) error
+	Create(name string) error
+	Destroy(name string) error
+	Open(name string, mode string, create bool, exclusive bool) (int, error)
+	Dup(handle int) error
+	Close(handle int) error
+	Read(handle int, p []byte) (int, error)
+	Write(handle int, p []byte) (int, error)
+	Seek(handle int, pos int) error
+	Directory() (string, error)
+}
+
+var currentFS fileSystem = simulatedFS{}
+
+// portableCommands are the commands that work with every fileSystem, the others need
+// the simulated disk
+var portableCommands = map[string]bool{
+	"in": true, "cr": true, "de": true, "op": true, "cl": true, "rd": true, "wr": true, "sk": true, "dr": true,
+	"wm": true, "rm": true, "wmx": true, "wmb": true, "rmx": true, "rmb": true,
+	"sp": true, "fk": true, "sw": true, "ex": true,
+}
+
+// simulatedFS is the simulated disk, handles are OFT entries
+type simulatedFS struct{}
+
+func (simulatedFS) Format(mode string) error {
+	if mode != "blocks" && mode != "extent" {
+		return errFS
+	}
+	finalizeDirectoryOFT()
+	allocationMode = mode
+	init_fs()
+	return nil
+}
+
+func (simulatedFS) Create(name string) error  { return fsCreate(name) }
+func (simulatedFS) Destroy(name string) error { return fsDestroy(name) }
+
+func (simulatedFS) Open(name string, mode string, create bool, exclusive bool) (int, error) {
+	handle := openFile(name, mode, create, exclusive)
+	if err := codeToError(handle); err != nil {
+		return -1, err
+	}
+	return handle, nil
+}
+
+func (simulatedFS) Dup(handle int) error {
+	if !retainOFTEntry(handle) {
+		return errFS
+	}
+	return nil
+}
+
+func (simulatedFS) Close(handle int) error                  { return fsClose(handle) }
+func (simulatedFS) Read(handle int, p []byte) (int, error)  { return fsRead(handle, p) }
+func (simulatedFS) Write(handle int, p []byte) (int, error) { return fsWrite(handle, p) }
+func (simulatedFS) Seek(handle int, pos int) error          { return fsSeek(handle, pos) }
+func (simulatedFS) Directory() (string, error)              { return fsDirectory() }
+
+// hostFS keeps files in a fresh directory under root for every in. Like the OFT it has
+// three entries, so handles and fds line up and scripts that fork behave the same.
+type hostFS struct {
+	root  string
+	dir   string
+	files [4]*os.File
+	refs  [4]int
+}
+
+func (h *hostFS) Format(mode string) error {
+	if mode != "blocks" && mode != "extent" {
+		return errFS
+	}
+	for i := 1; i < 4; i++ {
+		if h.files[i] != nil {
+			h.files[i].Close()
+			h.files[i] = nil
+		}
+	}
+	resetSession()
+	dir, err := os.MkdirTemp(h.root, "session")
+	if err != nil {
+		return err
+	}
+	h.dir = dir
+	return nil
+}
+
+// path keeps every name inside the session directory
+func (h *hostFS) path(name string) (string, error) {
+	if h.dir == "" || name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", errFS
+	}
+	return filepath.Join(h.dir, name), nil
+}
+
+func (h *hostFS) Create(name string) error {
+	path, err := h.path(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (h *hostFS) Destroy(name string) error {
+	path, err := h.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (h *hostFS) Open(name string, mode string, create bool, exclusive bool) (int, error) {
+	path, err := h.path(name)
+	if err != nil {
+		return -1, err
+	}
+	flags := map[string]int{"r": os.O_RDONLY, "w": os.O_WRONLY, "rw": os.O_RDWR, "a": os.O_WRONLY | os.O_APPEND}
+	flag, valid := flags[mode]
+	if !valid {
+		return -1, errFS
+	}
+	if create || exclusive {
+		flag |= os.O_CREATE
+	}
+	if exclusive {
+		flag |= os.O_EXCL
+	}
+
+	handle := -1
+	for i := 1; i < 4 && handle == -1; i++ {
+		if h.files[i] == nil {
+			handle = i
+		}
+	}
+	if handle == -1 {
+		return -1, errFS
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return -1, err
+	}
+	h.files[handle] = f
+	h.refs[handle] = 1
+	return handle, nil
+}
+
+func (h *hostFS) file(handle int) (*os.File, error) {
+	if handle < 1 || handle >= 4 || h.files[handle] == nil {
+		return nil, errFS
+	}
+	return h.files[handle], nil
+}
+
+func (h *hostFS) Dup(handle int) error {
+	if _, err := h.file(handle); err != nil {
+		return err
+	}
+	h.refs[handle]++
+	return nil
+}
+
+func (h *hostFS) Close(handle int) error {
+	f, err := h.file(handle)
+	if err != nil {
+		return err
+	}
+	h.refs[handle]--
+	if h.refs[handle] > 0 {
+		return nil
+	}
+	h.files[handle] = nil
+	return f.Close()
+}
+
+func (h *hostFS) Read(handle int, p []byte) (int, error) {
+	f, err := h.file(handle)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f, p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, nil
+	}
+	return n, err
+}
+
+func (h *hostFS) Write(handle int, p []byte) (int, error) {
+	f, err := h.file(handle)
+	if err != nil {
+		return 0, err
+	}
+	return f.Write(p)
+}
+
+func (h *hostFS) Seek(handle int, pos int) error {
+	f, err := h.file(handle)
+	if err != nil {
+		return err
+	}
+	if pos < 0 {
+		return errFS
+	}
+	_, err = f.Seek(int64(pos), io.SeekStart)
+	return err
+}
+
+// Directory lists the files by name, the order os.ReadDir returns them in
+func (h *hostFS) Directory() (string, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return "", err
+	}
+	listing := []string{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return "", err
+		}
+		listing = append(listing, entry.Name()+" "+strconv.FormatInt(info.Size(), 10))
+	}
+	return strings.Join(listing, " "), nil
+}
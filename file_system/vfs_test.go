@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestHostFS runs one script on the simulated disk and on a host directory. Within the
+// limits both share, the output has to be the same.
+func TestHostFS(t *testing.T) {
+	script := strings.Join([]string{
+		"in",
+		"cr a", "cr b", "cr a",
+		"op a rw", "wm 0 hello world", "wr 1 0 11", "sk 1 6", "rd 1 20 5", "rm 20 5",
+		"op b a", "wr 2 0 5", "sk 2 0", "wr 2 6 5", "rd 2 0 5",
+		"fk", "sw 1", "cl 2", "ex", "wr 2 0 1",
+		"op c r", "op c w c", "op c w x", "op ../a r",
+		"dr", "cl 1", "cl 2", "cl 3", "de b", "de b", "dr",
+		"in", "dr",
+	}, "\n")
+
+	var simulated bytes.Buffer
+	if err := run(strings.NewReader(script), &simulated); err != nil {
+		t.Fatal(err)
+	}
+
+	currentFS = &hostFS{root: t.TempDir()}
+	defer func() { currentFS = simulatedFS{} }()
+	var host bytes.Buffer
+	if err := run(strings.NewReader(script), &host); err != nil {
+		t.Fatal(err)
+	}
+
+	if host.String() != simulated.String() {
+		t.Errorf("host output differs\nhost:\n%s\nsimulated:\n%s", host.String(), simulated.String())
+	}
+
+	// commands that need the simulated disk are refused
+	host.Reset()
+	if err := run(strings.NewReader("in\ndf\nsnap s\n"), &host); err != nil {
+		t.Fatal(err)
+	}
+	if host.String() != "system initialized\nerror\nerror\n" {
+		t.Errorf("got %q", host.String())
+	}
+}
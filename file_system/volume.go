@@ -0,0 +1,222 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// VOLUME FUNCTIONS
+//
+// A session can use several disks. Each volume keeps its own disk, descriptors,
+// directory and allocation state, and only the active volume lives in the globals the
+// rest of the program works on, useVolume swaps them. OFT entries remember the volume
+// of their file, so the OFT spans volumes and commands on a descriptor switch to its
+// volume first. The root volume is the disk formatted by in, mounted on /.
+
+const rootVolume = "root"
+
+// volume holds the state of a disk while another one is active
+type volume struct {
+	disk [64][512]int
+	volumeMetadata
+}
+
+// volumeMetadata is the part of a volume kept in memory rather than in its blocks
+type volumeMetadata struct {
+	descriptors     [192][4]int
+	blockRefCount   [64]int
+	diskBlocks      int
+	allocationMode  string
+	snapshots       map[string][192][4]int
+	mountedSnapshot string
+	liveDescriptors [192][4]int
+	dirBuffer       [512]int
+	dirValid        bool
+	dirSize         int
+	dirLoadedBlock  int
+	dirNameIndex    map[string]directoryEntry
+	dirEntryIndex   map[int]int
+}
+
+// number of blocks of the active disk, blocks past it are never allocated
+var diskBlocks = 64
+
+var volumes = map[string]*volume{rootVolume: {}}
+var mountTable = map[string]string{"/": rootVolume} // mount point to disk name
+var activeVolume = rootVolume
+var oftVolume [4]string
+
+// diskCommands work on a whole disk rather than on a path or a descriptor
+var diskCommands = map[string]bool{
+	"dr": true, "df": true, "pm": true, "frag": true, "defrag": true, "hd": true, "pd": true, "cb": true,
+	"snap": true, "rollback": true, "snapdel": true, "snapmount": true, "snapumount": true, "sv": true, "ld": true, "pt": true,
+	"tarx": true, "tari": true,
+}
+
+func resetVolumes() {
+	volumes = map[string]*volume{rootVolume: {}}
+	mountTable = map[string]string{"/": rootVolume}
+	activeVolume = rootVolume
+	diskBlocks = 64
+}
+
+func storeVolume(v *volume) {
+	v.disk = disk
+	v.descriptors = descriptors
+	v.blockRefCount = blockRefCount
+	v.diskBlocks = diskBlocks
+	v.allocationMode = allocationMode
+	v.snapshots = snapshots
+	v.mountedSnapshot = mountedSnapshot
+	v.liveDescriptors = liveDescriptors
+	v.dirBuffer = oftBuffer[0]
+	v.dirValid = oftValid[0]
+	v.dirSize = oftFileSize[0]
+	v.dirLoadedBlock = oftLoadedBlock[0]
+	v.dirNameIndex = dirNameIndex
+	v.dirEntryIndex = dirEntryIndex
+}
+
+func restoreVolume(v *volume) {
+	disk = v.disk
+	descriptors = v.descriptors
+	blockRefCount = v.blockRefCount
+	diskBlocks = v.diskBlocks
+	allocationMode = v.allocationMode
+	snapshots = v.snapshots
+	mountedSnapshot = v.mountedSnapshot
+	liveDescriptors = v.liveDescriptors
+	oftBuffer[0] = v.dirBuffer
+	oftValid[0] = v.dirValid
+	oftFileSize[0] = v.dirSize
+	oftLoadedBlock[0] = v.dirLoadedBlock
+	dirNameIndex = v.dirNameIndex
+	dirEntryIndex = v.dirEntryIndex
+}
+
+// lockAll takes every lock but the leaf ones, in lock order
+func lockAll() {
+	dirMu.Lock()
+	for i := 1; i < 4; i++ {
+		oftMu[i].Lock()
+	}
+	allocMu.Lock()
+}
+
+func unlockAll() {
+	allocMu.Unlock()
+	for i := 3; i >= 1; i-- {
+		oftMu[i].Unlock()
+	}
+	dirMu.Unlock()
+}
+
+// useVolume makes a volume the active one. It holds every lock while the globals are
+// swapped, so it must not be called with any of them held.
+func useVolume(name string) {
+	if name == activeVolume || volumes[name] == nil {
+		return
+	}
+	lockAll()
+	storeVolume(volumes[activeVolume])
+	restoreVolume(volumes[name])
+	activeVolume = name
+	unlockAll()
+}
+
+// resolvePath splits a path into the disk mounted on its directory part and the file
+// name, a name without a directory is on the root volume
+func resolvePath(path string) (string, string, bool) {
+	mountPoint := "/"
+	name := path
+	if slash := strings.LastIndex(path, "/"); slash > 0 {
+		mountPoint = path[:slash]
+		name = path[slash+1:]
+	} else if slash == 0 {
+		name = path[1:]
+	}
+	diskName, mounted := mountTable[mountPoint]
+	if !mounted || name == "" {
+		return "", "", false
+	}
+	return diskName, name, true
+}
+
+// selectPath activates the volume a path is on and returns the file name in it
+func selectPath(path string) (string, bool) {
+	diskName, name, ok := resolvePath(path)
+	if !ok {
+		return "", false
+	}
+	useVolume(diskName)
+	return name, true
+}
+
+// selectMount activates the volume mounted on mountPoint
+func selectMount(mountPoint string) bool {
+	diskName, mounted := mountTable[mountPoint]
+	if !mounted {
+		return false
+	}
+	useVolume(diskName)
+	return true
+}
+
+// useFileVolume activates the volume of the file open in an OFT entry
+func useFileVolume(index int) {
+	if index >= 1 && index < 4 && oftValid[index] {
+		useVolume(oftVolume[index])
+	}
+}
+
+// make_disk formats a new disk of the given number of blocks, it is not mounted yet
+func make_disk(name string, blocks int, mode string) {
+	if _, exists := volumes[name]; exists || blocks <= firstDataBlock || blocks > 64 || (mode != "blocks" && mode != "extent") {
+		output = append(output, "error")
+		return
+	}
+
+	previous := activeVolume
+	volumes[name] = &volume{}
+	useVolume(name)
+	diskBlocks = blocks
+	allocationMode = mode
+	formatDisk()
+	useVolume(previous)
+	output = append(output, "disk "+name+" created with "+strconv.Itoa(blocks)+" blocks")
+}
+
+// mount_disk makes the files of a disk reachable as mountPoint/name
+func mount_disk(name string, mountPoint string) {
+	_, exists := volumes[name]
+	_, taken := mountTable[mountPoint]
+	if !exists || taken || len(mountPoint) < 2 || mountPoint[0] != '/' || strings.Contains(mountPoint[1:], "/") {
+		output = append(output, "error")
+		return
+	}
+	for _, mounted := range mountTable {
+		if mounted == name {
+			output = append(output, "error")
+			return
+		}
+	}
+	mountTable[mountPoint] = name
+	output = append(output, name+" mounted on "+mountPoint)
+}
+
+// unmount_disk detaches a disk again, none of its files may be open
+func unmount_disk(mountPoint string) {
+	name, mounted := mountTable[mountPoint]
+	if !mounted || mountPoint == "/" {
+		output = append(output, "error")
+		return
+	}
+	for i := 1; i < 4; i++ {
+		if oftValid[i] && oftVolume[i] == name {
+			output = append(output, "error")
+			return
+		}
+	}
+	delete(mountTable, mountPoint)
+	output = append(output, mountPoint+" unmounted")
+}